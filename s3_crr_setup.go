@@ -1,327 +1,4494 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"gopkg.in/yaml.v3"
 )
 
 func main() {
+	// Subcommands are dispatched on the first argument; anything else is the classic single-pair setup.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "apply":
+			runApply(os.Args[2:])
+			return
+		case "plan":
+			runPlan(os.Args[2:])
+			return
+		case "teardown":
+			runTeardown(os.Args[2:])
+			return
+		case "mesh":
+			runMesh(os.Args[2:])
+			return
+		case "sync-config":
+			runSyncConfig(os.Args[2:])
+			return
+		}
+	}
+	runSetup(os.Args[1:])
+}
+
+// runSetup configures replication for a single source/destination pair given on the command line.
+func runSetup(args []string) {
 	// Flags
-	srcBucket := flag.String("source-bucket", "", "Source bucket name (required)")
-	srcRegion := flag.String("source-region", "us-east-1", "Source bucket region")
-	dstBucket := flag.String("dest-bucket", "", "Destination bucket name (required)")
-	dstRegion := flag.String("dest-region", "us-west-2", "Destination bucket region")
-	roleName := flag.String("role-name", "s3-replication-role-example", "IAM Role name for replication")
-	profile := flag.String("profile", "", "AWS profile to use (optional)")
-	flag.Parse()
+	fs := flag.NewFlagSet("setup", flag.ExitOnError)
+	pair := addPairFlags(fs)
+	profile := fs.String("profile", "", "AWS profile to use (optional)")
+	refuseLegacy := fs.Bool("refuse-legacy-rules", false, "Fail instead of converting legacy V1 replication rules on the source bucket")
+	propagationTimeout := fs.Duration("propagation-timeout", defaultPropagationTimeout, "How long to retry calls failing while new roles and buckets propagate")
+	skipPreflight := fs.Bool("skip-preflight", false, "Do not check credentials, regions, the source buckets and permissions before making changes")
+	noRollback := fs.Bool("no-rollback", false, "Leave the changes made so far in place when a step fails instead of undoing them")
+	skipIAM := fs.Bool("skip-iam", false, "Do not create or change the replication role, only refer to it; for endpoints without IAM")
+	account := fs.String("account", "", "Account ID the replication roles are in; required with --skip-iam, which then makes no STS calls")
+	ep := addEndpointFlags(fs)
+	fs.Parse(args)
 
-	if *srcBucket == "" || *dstBucket == "" {
-		log.Fatalf("Both --source-bucket and --dest-bucket must be provided.")
+	if !pair.given() {
+		log.Fatalf("--source-bucket and either --dest-bucket or --dest must be provided.")
+	}
+	if *skipIAM && *account == "" {
+		log.Fatalf("--account must be provided with --skip-iam.")
+	}
+	opts := applyOptions{RefuseLegacyRules: *refuseLegacy, PropagationTimeout: *propagationTimeout, SkipIAM: *skipIAM, Account: *account}
+	sources, err := pair.sources()
+	if err != nil {
+		log.Fatalf("Invalid arguments: %v", err)
 	}
 
-	// Create sessions for source and destination regions. Use SharedConfigState to allow profile usage
-	srcSess := session.Must(session.NewSessionWithOptions(session.Options{
-		Config:            aws.Config{Region: aws.String(*srcRegion)},
-		Profile:           *profile,
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	dstSess := session.Must(session.NewSessionWithOptions(session.Options{
-		Config:            aws.Config{Region: aws.String(*dstRegion)},
-		Profile:           *profile,
+	src := sources[0]
+	if pair.Bidirectional {
+		fmt.Printf("Setting up bidirectional replication between %s (%s) and %s (%s)\n",
+			src.Bucket, src.Region, src.Destinations[0].Bucket, src.Destinations[0].Region)
+	} else {
+		for _, dst := range src.Destinations {
+			fmt.Printf("Setting up replication from %s (%s) -> %s (%s)\n", src.Bucket, src.Region, dst.Bucket, dst.Region)
+		}
+	}
+	sessionFor := newSessionCache(*profile, ep)
+	if !*skipPreflight {
+		if err := runPreflight(sessionFor, sources, *skipIAM); err != nil {
+			log.Fatalf("Preflight failed: %v", err)
+		}
+	}
+	journal := &changeJournal{}
+	for _, s := range sources {
+		if err := reconcileSource(sessionFor, s, opts, journal); err != nil {
+			failRun(journal, *noRollback, "Failed to set up replication from %s: %v", s.Bucket, err)
+		}
+	}
+
+	fmt.Println("Cross-region replication setup complete.")
+}
+
+// pairFlags describe a single source and its destinations on the command line, for setup and plan.
+// Base collects the settings every destination given with --dest-bucket or --dest shares.
+type pairFlags struct {
+	SrcBucket, SrcRegion, SrcKMSKey, SrcAccount string
+	DstBucket, DstRegion                        string
+	Role, RolePath, PermissionsBoundary         string
+	RoleTags                                    tagFlag
+	Bidirectional                               bool
+	Base                                        DestinationSpec
+	Extra                                       destFlag
+}
+
+// addPairFlags registers the flags describing a single source and its destinations on fs.
+func addPairFlags(fs *flag.FlagSet) *pairFlags {
+	p := &pairFlags{RoleTags: tagFlag{}}
+	tags, bucketTags := tagFlag{}, tagFlag{}
+	p.Base.Tags, p.Base.BucketTags = tags, bucketTags
+	fs.StringVar(&p.SrcBucket, "source-bucket", "", "Source bucket name (required unless plan is given --topology)")
+	fs.StringVar(&p.SrcRegion, "source-region", "us-east-1", "Source bucket region")
+	fs.StringVar(&p.DstBucket, "dest-bucket", "", "Destination bucket name (required unless --dest is given)")
+	fs.StringVar(&p.DstRegion, "dest-region", "us-west-2", "Destination bucket region")
+	fs.StringVar(&p.Role, "role-name", "s3-replication-role-example", "IAM Role name for replication")
+	fs.StringVar(&p.Base.Prefix, "prefix", "", "Only replicate objects under this key prefix (optional)")
+	fs.Var(tags, "tag", "Only replicate objects carrying this tag, as key=value (repeatable)")
+	fs.StringVar(&p.SrcKMSKey, "source-kms-key-arn", "", "KMS key ARN used for SSE-KMS objects in the source bucket (optional)")
+	fs.StringVar(&p.Base.KMSKeyArn, "dest-kms-key-arn", "", "KMS key ARN to encrypt replicas with in the destination region (required with --source-kms-key-arn)")
+	fs.StringVar(&p.Base.Account, "dest-account", "", "Destination account ID when the destination bucket is owned by another account (optional)")
+	fs.StringVar(&p.Base.Profile, "dest-profile", "", "AWS profile for the destination account; defaults to --profile (optional)")
+	fs.BoolVar(&p.Base.ReplicationTimeControl, "rtc", false, "Enable S3 Replication Time Control (15 minutes); requires --metrics")
+	fs.BoolVar(&p.Base.Metrics, "metrics", false, "Enable replication metrics with a 15 minute event threshold; requires --rtc")
+	fs.BoolVar(&p.Base.DeleteMarkerReplication, "delete-marker-replication", false, "Replicate delete markers to the destination")
+	fs.BoolVar(&p.Base.ExistingObjectReplication, "existing-object-replication", false, "Replicate objects that existed before the rule was created")
+	fs.StringVar(&p.Base.StorageClass, "storage-class", "", "Storage class for replicas, e.g. STANDARD_IA, GLACIER_IR, DEEP_ARCHIVE (default: same as source)")
+	fs.BoolVar(&p.Bidirectional, "bidirectional", false, "Also replicate from the destination back to the source, syncing replica modifications")
+	fs.StringVar(&p.SrcAccount, "source-account", "", "Source account ID; required with --bidirectional and --dest-account")
+	fs.StringVar(&p.RolePath, "role-path", "", "Path for a new replication role, e.g. /service-roles/ (optional)")
+	fs.StringVar(&p.PermissionsBoundary, "permissions-boundary", "", "ARN of a managed policy to set as the role's permissions boundary (optional)")
+	fs.Var(p.RoleTags, "role-tag", "Tag to put on the role, as key=value (repeatable)")
+	fs.Var(bucketTags, "bucket-tag", "Standard tag a destination bucket must carry, as key=value (repeatable); put on created buckets, checked on existing ones")
+	fs.Var(&p.Extra, "dest", "Additional destination as bucket:region[:storageClass][:kmsKeyArn] (repeatable); shares the other destination flags")
+	return p
+}
+
+// given reports whether a source and at least one destination were given.
+func (p *pairFlags) given() bool {
+	return p.SrcBucket != "" && (p.DstBucket != "" || len(p.Extra) > 0)
+}
+
+// sources builds and validates the sources the flags describe: the source with its destinations, and with
+// --bidirectional also the destination replicating back to the source.
+func (p *pairFlags) sources() ([]SourceSpec, error) {
+	src := SourceSpec{
+		Bucket: p.SrcBucket, Region: p.SrcRegion, Role: p.Role, KMSKeyArn: p.SrcKMSKey,
+		Destinations: pairDestinations(p.Base, p.DstBucket, p.DstRegion, p.Extra),
+		RolePath:     p.RolePath, PermissionsBoundary: p.PermissionsBoundary, RoleTags: p.RoleTags,
+	}
+	sources := []SourceSpec{src}
+	if p.Bidirectional {
+		if len(src.Destinations) != 1 {
+			return nil, fmt.Errorf("--bidirectional takes exactly one destination")
+		}
+		if p.Base.Account != "" && p.SrcAccount == "" {
+			return nil, fmt.Errorf("--source-account must be provided with --bidirectional and --dest-account")
+		}
+		sources = bidirectionalSources(src, p.SrcAccount)
+	}
+	if err := (&Topology{Sources: sources}).validate(); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// profileOr returns profile, or fallback when profile is empty.
+func profileOr(profile, fallback string) string {
+	if profile != "" {
+		return profile
+	}
+	return fallback
+}
+
+// newSession creates a session for the given region. Use SharedConfigState to allow profile usage.
+// ep sends the session's requests to other endpoints than AWS's own.
+func newSession(region, profile string, ep *endpointOptions) *session.Session {
+	return session.Must(session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Region:           aws.String(region),
+			EndpointResolver: ep.resolver(),
+			S3ForcePathStyle: aws.Bool(ep.ForcePathStyle),
+		},
+		Profile:           profile,
 		SharedConfigState: session.SharedConfigEnable,
 	}))
+}
+
+// endpointOptions point the sessions at S3-compatible endpoints such as LocalStack or MinIO instead of AWS.
+// URL is used for every service in every region, Regions overrides it for single regions and IAMURL for IAM.
+// ForcePathStyle addresses buckets as <endpoint>/<bucket>, which local endpoints need.
+type endpointOptions struct {
+	URL            string
+	Regions        tagFlag
+	IAMURL         string
+	ForcePathStyle bool
+}
+
+// addEndpointFlags registers the endpoint flags on fs.
+func addEndpointFlags(fs *flag.FlagSet) *endpointOptions {
+	ep := &endpointOptions{Regions: tagFlag{}}
+	fs.StringVar(&ep.URL, "endpoint-url", "", "Send requests to this endpoint instead of AWS, e.g. http://localhost:4566 for LocalStack (optional)")
+	fs.Var(ep.Regions, "region-endpoint", "Endpoint for one region, as region=url (repeatable); overrides --endpoint-url in that region")
+	fs.StringVar(&ep.IAMURL, "iam-endpoint-url", "", "Send IAM requests to this endpoint; defaults to the region's endpoint (optional)")
+	fs.BoolVar(&ep.ForcePathStyle, "s3-force-path-style", false, "Address buckets as <endpoint>/<bucket> instead of <bucket>.<endpoint>, as MinIO and LocalStack need")
+	return ep
+}
+
+// resolver returns an endpoint resolver applying the overrides, or nil to use AWS's endpoints.
+func (ep *endpointOptions) resolver() endpoints.Resolver {
+	if ep.URL == "" && len(ep.Regions) == 0 && ep.IAMURL == "" {
+		return nil
+	}
+	return endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		endpoint := ep.URL
+		if u, ok := ep.Regions[region]; ok {
+			endpoint = u
+		}
+		if service == endpoints.IamServiceID && ep.IAMURL != "" {
+			endpoint = ep.IAMURL
+		}
+		if endpoint == "" {
+			return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+		}
+		return endpoints.ResolvedEndpoint{URL: endpoint, SigningRegion: region}, nil
+	})
+}
+
+// Topology describes every replication pair the apply command converges to.
+type Topology struct {
+	Profile string       `json:"profile,omitempty" yaml:"profile,omitempty"`
+	Sources []SourceSpec `json:"sources" yaml:"sources"`
+}
+
+// SourceSpec is a source bucket together with the role used to replicate it and its destinations.
+// KMSKeyArn is the key SSE-KMS objects in the source are encrypted with; when set, those objects are replicated too.
+// Profile selects the credentials for the source bucket's account and its role; empty uses the topology profile.
+// RolePath, PermissionsBoundary and RoleTags are applied to the role; the path only when the role is created.
+// ObjectLock is not read from topology files; it is set at run time when the source bucket has Object Lock enabled.
+type SourceSpec struct {
+	Bucket       string            `json:"bucket" yaml:"bucket"`
+	Region       string            `json:"region" yaml:"region"`
+	Role         string            `json:"role" yaml:"role"`
+	KMSKeyArn    string            `json:"kmsKeyArn,omitempty" yaml:"kmsKeyArn,omitempty"`
+	Profile      string            `json:"profile,omitempty" yaml:"profile,omitempty"`
+	Destinations []DestinationSpec `json:"destinations" yaml:"destinations"`
+
+	RolePath            string            `json:"rolePath,omitempty" yaml:"rolePath,omitempty"`
+	PermissionsBoundary string            `json:"permissionsBoundary,omitempty" yaml:"permissionsBoundary,omitempty"`
+	RoleTags            map[string]string `json:"roleTags,omitempty" yaml:"roleTags,omitempty"`
+
+	ObjectLock bool `json:"-" yaml:"-"`
+}
+
+// DestinationSpec is a destination bucket and the options of the rules replicating to it.
+// Prefix, Tags and Priority describe a single rule; use Filters instead for several rules with different filters.
+// KMSKeyArn is the key replicas of SSE-KMS objects are encrypted with in the destination region.
+// Account and Profile are set when the destination bucket belongs to another account; replicas are then
+// owned by that account and the bucket is managed with the destination profile's credentials.
+// ReplicationTimeControl and Metrics enable S3 Replication Time Control and replication metrics, which AWS
+// only accepts together. DeleteMarkerReplication mirrors delete markers (leave it off for backup targets) and
+// ExistingObjectReplication also replicates objects created before the rule.
+// StorageClass is the class replicas land in; empty keeps the source object's class.
+// ReplicaModifications syncs metadata changes made to replicas in the source bucket, which two buckets
+// replicating to each other need.
+// BucketTags are the standard tags the destination bucket must carry: they are put on a bucket the tool creates
+// and checked on an existing one, together with the other bucket defaults (see bucketDefaults).
+type DestinationSpec struct {
+	Bucket    string            `json:"bucket" yaml:"bucket"`
+	Region    string            `json:"region" yaml:"region"`
+	Prefix    string            `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Priority  int64             `json:"priority,omitempty" yaml:"priority,omitempty"`
+	Filters   []FilterSpec      `json:"filters,omitempty" yaml:"filters,omitempty"`
+	KMSKeyArn string            `json:"kmsKeyArn,omitempty" yaml:"kmsKeyArn,omitempty"`
+	Account   string            `json:"account,omitempty" yaml:"account,omitempty"`
+	Profile   string            `json:"profile,omitempty" yaml:"profile,omitempty"`
+
+	StorageClass string `json:"storageClass,omitempty" yaml:"storageClass,omitempty"`
+
+	ReplicationTimeControl bool `json:"replicationTimeControl,omitempty" yaml:"replicationTimeControl,omitempty"`
+	Metrics                bool `json:"metrics,omitempty" yaml:"metrics,omitempty"`
+
+	DeleteMarkerReplication   bool `json:"deleteMarkerReplication,omitempty" yaml:"deleteMarkerReplication,omitempty"`
+	ExistingObjectReplication bool `json:"existingObjectReplication,omitempty" yaml:"existingObjectReplication,omitempty"`
+
+	ReplicaModifications bool `json:"replicaModifications,omitempty" yaml:"replicaModifications,omitempty"`
+
+	BucketTags map[string]string `json:"bucketTags,omitempty" yaml:"bucketTags,omitempty"`
+}
+
+// bidirectionalSources turns a single source and destination into two sources replicating to each other,
+// both with replica modification sync. The reverse direction uses a role with the same name: when both
+// buckets are in one account that is the same role, otherwise a second role in the destination account.
+// The reverse rule keeps the forward rule's filter, but not its replica storage class or standard bucket
+// tags, which were chosen for the destination.
+// srcAccount is the source bucket's account and is only needed when the destination is in another account.
+func bidirectionalSources(src SourceSpec, srcAccount string) []SourceSpec {
+	forward := src
+	dst := src.Destinations[0]
+	dst.ReplicaModifications = true
+	forward.Destinations = []DestinationSpec{dst}
+
+	back := dst
+	back.Bucket, back.Region, back.KMSKeyArn = src.Bucket, src.Region, src.KMSKeyArn
+	back.StorageClass, back.BucketTags = "", nil
+	back.Account, back.Profile = "", src.Profile
+	if dst.Account != "" {
+		back.Account = srcAccount
+	}
+	reverse := SourceSpec{
+		Bucket:       dst.Bucket,
+		Region:       dst.Region,
+		Role:         src.Role,
+		KMSKeyArn:    dst.KMSKeyArn,
+		Profile:      dst.Profile,
+		Destinations: []DestinationSpec{back},
+		RolePath:     src.RolePath,
+		RoleTags:     src.RoleTags,
+	}
+	if dst.Account == "" {
+		// A permissions boundary is a policy of the source account; another account would need its own
+		reverse.PermissionsBoundary = src.PermissionsBoundary
+	}
+	return []SourceSpec{forward, reverse}
+}
+
+// replicaStorageClasses are the storage classes S3 accepts for replicas.
+var replicaStorageClasses = []string{
+	"STANDARD",
+	"REDUCED_REDUNDANCY",
+	"STANDARD_IA",
+	"ONEZONE_IA",
+	"INTELLIGENT_TIERING",
+	"GLACIER",
+	"GLACIER_IR",
+	"DEEP_ARCHIVE",
+}
+
+// validateStorageClass rejects storage classes that cannot be used as a replication target.
+func validateStorageClass(class string) error {
+	for _, c := range replicaStorageClasses {
+		if class == c {
+			return nil
+		}
+	}
+	return fmt.Errorf("storage class %q cannot be used for replicas, use one of %s", class, strings.Join(replicaStorageClasses, ", "))
+}
+
+// replicationTimeMinutes is the only replication time and metrics event threshold S3 accepts.
+const replicationTimeMinutes = 15
+
+// FilterSpec selects the objects one rule replicates: objects under Prefix that carry all of Tags.
+type FilterSpec struct {
+	Prefix   string            `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Priority int64             `json:"priority,omitempty" yaml:"priority,omitempty"`
+}
+
+// filters returns one FilterSpec per rule to create for the destination.
+func (d DestinationSpec) filters() []FilterSpec {
+	if len(d.Filters) > 0 {
+		return d.Filters
+	}
+	return []FilterSpec{{Prefix: d.Prefix, Tags: d.Tags, Priority: d.Priority}}
+}
+
+// tagFlag collects repeated --tag key=value flags.
+type tagFlag map[string]string
+
+func (t tagFlag) String() string {
+	var pairs []string
+	for k, v := range t {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (t tagFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	t[k] = v
+	return nil
+}
+
+// destFlag collects repeated --dest bucket:region[:storageClass][:kmsKeyArn] flags. The KMS key ARN contains colons
+// itself and is recognised by its arn: prefix.
+type destFlag []DestinationSpec
+
+func (d *destFlag) String() string {
+	var dests []string
+	for _, dst := range *d {
+		dests = append(dests, dst.Bucket+":"+dst.Region)
+	}
+	return strings.Join(dests, ",")
+}
+
+func (d *destFlag) Set(value string) error {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("expected bucket:region[:storageClass][:kmsKeyArn], got %q", value)
+	}
+	dst := DestinationSpec{Bucket: parts[0], Region: parts[1]}
+	if len(parts) == 3 {
+		rest := parts[2]
+		if !strings.HasPrefix(rest, "arn:") {
+			dst.StorageClass, rest, _ = strings.Cut(rest, ":")
+		}
+		if rest != "" && !strings.HasPrefix(rest, "arn:") {
+			return fmt.Errorf("expected bucket:region[:storageClass][:kmsKeyArn], got %q", value)
+		}
+		dst.KMSKeyArn = rest
+	}
+	*d = append(*d, dst)
+	return nil
+}
+
+// pairDestinations builds the destinations of a single setup or plan run: --dest-bucket (if given) followed by
+// every --dest. They all share the options in base; a storage class or KMS key given in --dest overrides base's.
+func pairDestinations(base DestinationSpec, dstBucket, dstRegion string, extra destFlag) []DestinationSpec {
+	var dests []DestinationSpec
+	if dstBucket != "" {
+		dst := base
+		dst.Bucket, dst.Region = dstBucket, dstRegion
+		dests = append(dests, dst)
+	}
+	for _, e := range extra {
+		dst := base
+		dst.Bucket, dst.Region = e.Bucket, e.Region
+		if e.StorageClass != "" {
+			dst.StorageClass = e.StorageClass
+		}
+		if e.KMSKeyArn != "" {
+			dst.KMSKeyArn = e.KMSKeyArn
+		}
+		dests = append(dests, dst)
+	}
+	return dests
+}
+
+// loadTopology reads a topology file. Files ending in .yaml or .yml are parsed as YAML, everything else as JSON.
+// Unknown keys are rejected, so that a misspelt option is not silently ignored.
+func loadTopology(path string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var topo Topology
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&topo)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&topo)
+	}
+	if errors.Is(err, io.EOF) {
+		// Empty file; validate reports the missing sources
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := topo.validate(); err != nil {
+		return nil, fmt.Errorf("invalid topology %s: %w", path, err)
+	}
+	return &topo, nil
+}
+
+// validate checks required fields and rejects configurations AWS would refuse.
+func (t *Topology) validate() error {
+	if len(t.Sources) == 0 {
+		return fmt.Errorf("no sources defined")
+	}
+	// Replication cannot cross partitions, so every bucket must be in the partition of the first source
+	partition := partitionFor(t.Sources[0].Region)
+	seenSources := make(map[string]bool)
+	for _, src := range t.Sources {
+		if src.Bucket == "" || src.Region == "" || src.Role == "" {
+			return fmt.Errorf("source %q: bucket, region and role are required", src.Bucket)
+		}
+		if p := partitionFor(src.Region); p != partition {
+			return fmt.Errorf("source %s: region %s is in partition %s, other buckets are in %s; replication cannot cross partitions", src.Bucket, src.Region, p, partition)
+		}
+		if seenSources[src.Bucket] {
+			return fmt.Errorf("source %s is listed more than once", src.Bucket)
+		}
+		seenSources[src.Bucket] = true
+		if len(src.Destinations) == 0 {
+			return fmt.Errorf("source %s: no destinations defined", src.Bucket)
+		}
+		if src.KMSKeyArn != "" {
+			if err := validateKMSKeyArn(src.KMSKeyArn, src.Region); err != nil {
+				return fmt.Errorf("source %s: %w", src.Bucket, err)
+			}
+		}
+		if src.RolePath != "" && (!strings.HasPrefix(src.RolePath, "/") || !strings.HasSuffix(src.RolePath, "/")) {
+			return fmt.Errorf("source %s: role path %q must begin and end with /", src.Bucket, src.RolePath)
+		}
+		if src.PermissionsBoundary != "" && !strings.Contains(src.PermissionsBoundary, ":policy/") {
+			return fmt.Errorf("source %s: permissions boundary %q is not a managed policy ARN", src.Bucket, src.PermissionsBoundary)
+		}
+		seenDests := make(map[string]bool)
+		seenPriorities := make(map[int64]bool)
+		for _, dst := range src.Destinations {
+			if dst.Bucket == "" || dst.Region == "" {
+				return fmt.Errorf("source %s: destination bucket and region are required", src.Bucket)
+			}
+			if dst.Bucket == src.Bucket {
+				return fmt.Errorf("source %s: cannot replicate to itself", src.Bucket)
+			}
+			if p := partitionFor(dst.Region); p != partition {
+				return fmt.Errorf("source %s: destination %s: region %s is in partition %s, the source in %s; replication cannot cross partitions", src.Bucket, dst.Bucket, dst.Region, p, partition)
+			}
+			if seenDests[dst.Bucket] {
+				return fmt.Errorf("source %s: destination %s is listed more than once", src.Bucket, dst.Bucket)
+			}
+			seenDests[dst.Bucket] = true
+			// SseKmsEncryptedObjects and ReplicaKmsKeyID must be set together
+			if (src.KMSKeyArn == "") != (dst.KMSKeyArn == "") {
+				return fmt.Errorf("source %s: destination %s: source and destination KMS keys must be set together", src.Bucket, dst.Bucket)
+			}
+			if dst.KMSKeyArn != "" {
+				if err := validateKMSKeyArn(dst.KMSKeyArn, dst.Region); err != nil {
+					return fmt.Errorf("source %s: destination %s: %w (each destination region needs its own key: "+
+						"give it as --dest bucket:region[:storageClass]:kmsKeyArn or as kmsKeyArn on the destination in a topology file)",
+						src.Bucket, dst.Bucket, err)
+				}
+			}
+			if dst.StorageClass != "" {
+				if err := validateStorageClass(dst.StorageClass); err != nil {
+					return fmt.Errorf("source %s: destination %s: %w", src.Bucket, dst.Bucket, err)
+				}
+			}
+			if dst.ReplicationTimeControl != dst.Metrics {
+				return fmt.Errorf("source %s: destination %s: replication time control and metrics must be enabled together", src.Bucket, dst.Bucket)
+			}
+			for k := range dst.BucketTags {
+				if k == "" || k == createdByTagKey || strings.HasPrefix(k, "aws:") {
+					return fmt.Errorf("source %s: destination %s: bucket tag key %q is empty or reserved", src.Bucket, dst.Bucket, k)
+				}
+			}
+			if dst.Account != "" && !isAccountID(dst.Account) {
+				return fmt.Errorf("source %s: destination %s: account %q is not a 12-digit account ID", src.Bucket, dst.Bucket, dst.Account)
+			}
+			if len(dst.Filters) > 0 && (dst.Prefix != "" || len(dst.Tags) > 0 || dst.Priority != 0) {
+				return fmt.Errorf("source %s: destination %s sets both filters and prefix/tags/priority", src.Bucket, dst.Bucket)
+			}
+			for _, f := range dst.filters() {
+				if f.Priority < 0 {
+					return fmt.Errorf("source %s: destination %s has a negative priority", src.Bucket, dst.Bucket)
+				}
+				if f.Priority > 0 {
+					if seenPriorities[f.Priority] {
+						return fmt.Errorf("source %s: priority %d is used more than once", src.Bucket, f.Priority)
+					}
+					seenPriorities[f.Priority] = true
+				}
+				for k := range f.Tags {
+					if k == "" {
+						return fmt.Errorf("source %s: destination %s has a tag filter with an empty key", src.Bucket, dst.Bucket)
+					}
+				}
+				if len(f.Tags) > 0 && dst.DeleteMarkerReplication {
+					return fmt.Errorf("source %s: destination %s: delete marker replication is not supported with tag filters", src.Bucket, dst.Bucket)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isAccountID reports whether id looks like an AWS account ID.
+func isAccountID(id string) bool {
+	if len(id) != 12 {
+		return false
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// validateKMSKeyArn checks that arn is a full KMS key ARN (aliases are not accepted for replication) in region and
+// its partition.
+func validateKMSKeyArn(arn, region string) error {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "kms" || !strings.HasPrefix(parts[5], "key/") {
+		return fmt.Errorf("%q is not a KMS key ARN (arn:<partition>:kms:<region>:<account>:key/<id>)", arn)
+	}
+	if parts[3] != region {
+		return fmt.Errorf("KMS key %s is in %s, expected %s", arn, parts[3], region)
+	}
+	if p := partitionFor(region); parts[1] != p {
+		return fmt.Errorf("KMS key %s is in partition %s, expected %s", arn, parts[1], p)
+	}
+	return nil
+}
+
+// runApply reconciles every source in a topology file. It is safe to re-run: existing buckets, roles and
+// up-to-date replication configurations are left as they are.
+func runApply(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	topologyPath := fs.String("topology", "", "Path to topology file, JSON or YAML (required)")
+	profile := fs.String("profile", "", "AWS profile to use; overrides the profile in the topology file (optional)")
+	refuseLegacy := fs.Bool("refuse-legacy-rules", false, "Fail instead of converting legacy V1 replication rules on source buckets")
+	propagationTimeout := fs.Duration("propagation-timeout", defaultPropagationTimeout, "How long to retry calls failing while new roles and buckets propagate")
+	skipPreflight := fs.Bool("skip-preflight", false, "Do not check credentials, regions, the source buckets and permissions before making changes")
+	noRollback := fs.Bool("no-rollback", false, "Leave the changes made so far in place when a step fails instead of undoing them")
+	skipIAM := fs.Bool("skip-iam", false, "Do not create or change the replication role, only refer to it; for endpoints without IAM")
+	account := fs.String("account", "", "Account ID the replication roles are in; required with --skip-iam, which then makes no STS calls")
+	ep := addEndpointFlags(fs)
+	fs.Parse(args)
+
+	if *topologyPath == "" {
+		log.Fatalf("--topology must be provided.")
+	}
+	if *skipIAM && *account == "" {
+		log.Fatalf("--account must be provided with --skip-iam.")
+	}
+	topo, err := loadTopology(*topologyPath)
+	if err != nil {
+		log.Fatalf("Failed to load topology: %v", err)
+	}
+	if *profile != "" {
+		topo.Profile = *profile
+	}
+
+	sessionFor := newSessionCache(topo.Profile, ep)
+	if !*skipPreflight {
+		if err := runPreflight(sessionFor, topo.Sources, *skipIAM); err != nil {
+			log.Fatalf("Preflight failed: %v", err)
+		}
+	}
+	journal := &changeJournal{}
+	for _, src := range topo.Sources {
+		opts := applyOptions{Prune: true, RefuseLegacyRules: *refuseLegacy, PropagationTimeout: *propagationTimeout, SkipIAM: *skipIAM, Account: *account}
+		if err := reconcileSource(sessionFor, src, opts, journal); err != nil {
+			failRun(journal, *noRollback, "Failed to reconcile source %s: %v", src.Bucket, err)
+		}
+	}
+	fmt.Println("Topology applied.")
+}
+
+// runMesh replicates every bucket in a list to every other one. It shows the resulting topology and asks
+// for confirmation before applying it.
+func runMesh(args []string) {
+	fs := flag.NewFlagSet("mesh", flag.ExitOnError)
+	var buckets destFlag
+	fs.Var(&buckets, "bucket", "Bucket in the mesh as bucket:region[:storageClass] (repeat for every bucket); the storage class applies to replicas written to it")
+	rolePrefix := fs.String("role-prefix", "s3-replication-mesh", "Prefix of the per-source IAM role names, <prefix>-<bucket>")
+	profile := fs.String("profile", "", "AWS profile to use (optional)")
+	rtc := fs.Bool("rtc", false, "Enable S3 Replication Time Control (15 minutes) on every rule; requires --metrics")
+	metrics := fs.Bool("metrics", false, "Enable replication metrics with a 15 minute event threshold on every rule; requires --rtc")
+	deleteMarkers := fs.Bool("delete-marker-replication", false, "Replicate delete markers between the buckets")
+	bucketTags := tagFlag{}
+	fs.Var(bucketTags, "bucket-tag", "Standard tag every bucket must carry, as key=value (repeatable); put on created buckets, checked on existing ones")
+	refuseLegacy := fs.Bool("refuse-legacy-rules", false, "Fail instead of converting legacy V1 replication rules")
+	propagationTimeout := fs.Duration("propagation-timeout", defaultPropagationTimeout, "How long to retry calls failing while new roles and buckets propagate")
+	skipPreflight := fs.Bool("skip-preflight", false, "Do not check credentials, regions, the source buckets and permissions before making changes")
+	noRollback := fs.Bool("no-rollback", false, "Leave the changes made so far in place when a step fails instead of undoing them")
+	assumeYes := fs.Bool("yes", false, "Apply without asking for confirmation")
+	skipIAM := fs.Bool("skip-iam", false, "Do not create or change the replication role, only refer to it; for endpoints without IAM")
+	account := fs.String("account", "", "Account ID the replication roles are in; required with --skip-iam, which then makes no STS calls")
+	ep := addEndpointFlags(fs)
+	fs.Parse(args)
+
+	if len(buckets) < 2 {
+		log.Fatalf("At least two --bucket arguments must be provided.")
+	}
+	if *skipIAM && *account == "" {
+		log.Fatalf("--account must be provided with --skip-iam.")
+	}
+	base := DestinationSpec{ReplicationTimeControl: *rtc, Metrics: *metrics, DeleteMarkerReplication: *deleteMarkers, BucketTags: bucketTags}
+	topo, err := meshTopology(buckets, *rolePrefix, base)
+	if err != nil {
+		log.Fatalf("Invalid arguments: %v", err)
+	}
+	topo.Profile = *profile
+
+	out, err := yaml.Marshal(topo)
+	if err != nil {
+		log.Fatalf("Failed to render topology: %v", err)
+	}
+	fmt.Printf("Mesh of %d buckets, %d replication rules:\n\n%s\n", len(buckets), len(buckets)*(len(buckets)-1), out)
+	sessionFor := newSessionCache(topo.Profile, ep)
+	if !*skipPreflight {
+		if err := runPreflight(sessionFor, topo.Sources, *skipIAM); err != nil {
+			log.Fatalf("Preflight failed: %v", err)
+		}
+	}
+	if !confirm(*assumeYes, "Apply this topology?") {
+		fmt.Println("Nothing applied.")
+		return
+	}
+
+	journal := &changeJournal{}
+	for _, src := range topo.Sources {
+		opts := applyOptions{RefuseLegacyRules: *refuseLegacy, PropagationTimeout: *propagationTimeout, SkipIAM: *skipIAM, Account: *account}
+		if err := reconcileSource(sessionFor, src, opts, journal); err != nil {
+			failRun(journal, *noRollback, "Failed to reconcile source %s: %v", src.Bucket, err)
+		}
+	}
+	fmt.Println("Mesh applied.")
+}
+
+// meshTopology builds a topology in which every bucket replicates to every other one with replica modification
+// sync. Each source gets its own role, <rolePrefix>-<bucket>. The other options of base apply to every rule.
+func meshTopology(buckets []DestinationSpec, rolePrefix string, base DestinationSpec) (*Topology, error) {
+	topo := &Topology{}
+	for _, src := range buckets {
+		if src.KMSKeyArn != "" {
+			return nil, fmt.Errorf("bucket %s: mesh does not support KMS keys, use a topology file with apply", src.Bucket)
+		}
+		role := rolePrefix + "-" + src.Bucket
+		if len(role) > 64 {
+			return nil, fmt.Errorf("role name %s is longer than 64 characters, use a shorter --role-prefix", role)
+		}
+		spec := SourceSpec{Bucket: src.Bucket, Region: src.Region, Role: role}
+		for _, dst := range buckets {
+			if dst.Bucket == src.Bucket {
+				continue
+			}
+			d := base
+			d.Bucket, d.Region, d.StorageClass = dst.Bucket, dst.Region, dst.StorageClass
+			d.ReplicaModifications = true
+			spec.Destinations = append(spec.Destinations, d)
+		}
+		topo.Sources = append(topo.Sources, spec)
+	}
+	if err := topo.validate(); err != nil {
+		return nil, err
+	}
+	return topo, nil
+}
+
+// runSyncConfig copies the bucket-level configuration of a source bucket (lifecycle rules, CORS, bucket policy,
+// tags and intelligent-tiering configurations) to every destination in its replication rules.
+func runSyncConfig(args []string) {
+	fs := flag.NewFlagSet("sync-config", flag.ExitOnError)
+	srcBucket := fs.String("source-bucket", "", "Source bucket name (required)")
+	srcRegion := fs.String("source-region", "us-east-1", "Source bucket region")
+	profile := fs.String("profile", "", "AWS profile to use (optional)")
+	dstProfile := fs.String("dest-profile", "", "AWS profile for destinations in other accounts; defaults to --profile (optional)")
+	dryRun := fs.Bool("dry-run", false, "Only print what would be copied")
+	ep := addEndpointFlags(fs)
+	fs.Parse(args)
+
+	if *srcBucket == "" {
+		log.Fatalf("--source-bucket must be provided.")
+	}
+	sessionFor := newSessionCache(*profile, ep)
+	s3Src := s3.New(sessionFor(*srcRegion, ""))
+	cfg, err := readBucketConfig(s3Src, *srcBucket, *srcRegion)
+	if err != nil {
+		log.Fatalf("Failed to read configuration of %s: %v", *srcBucket, err)
+	}
+	replication, err := getReplicationConfiguration(s3Src, *srcBucket)
+	if err != nil {
+		log.Fatalf("Failed to read replication configuration of %s: %v", *srcBucket, err)
+	}
+	if replication == nil {
+		log.Fatalf("%s has no replication configuration, so there are no destinations to sync.", *srcBucket)
+	}
+
+	counts := make(map[string]int)
+	seen := make(map[string]bool)
+	var failed []string
+	for _, rule := range replication.Rules {
+		if rule.Destination == nil {
+			continue
+		}
+		dstBucket := bucketFromArn(aws.StringValue(rule.Destination.Bucket))
+		if dstBucket == "" || seen[dstBucket] {
+			continue
+		}
+		seen[dstBucket] = true
+		// Destinations owned by another account are reached with its profile
+		profile := ""
+		if rule.Destination.Account != nil {
+			profile = *dstProfile
+		}
+		dstRegion, err := getBucketRegion(s3.New(sessionFor(*srcRegion, profile)), dstBucket)
+		if err != nil {
+			fmt.Printf("\nFailed to find the region of %s: %v\n", dstBucket, err)
+			failed = append(failed, dstBucket)
+			continue
+		}
+		items, err := syncBucketConfig(s3.New(sessionFor(dstRegion, profile)), dstBucket, dstRegion, cfg, *dryRun)
+		fmt.Printf("\nConfiguration of %s (%s) -> %s (%s):\n", *srcBucket, *srcRegion, dstBucket, dstRegion)
+		if len(items) == 0 && err == nil {
+			fmt.Println("  Already in sync.")
+		}
+		for _, item := range items {
+			fmt.Printf("  %s %s\n", item.Action, item.Resource)
+			for _, d := range item.Details {
+				fmt.Printf("      %s\n", d)
+			}
+			counts[item.Action]++
+		}
+		if err != nil {
+			// Carry on with the other destinations
+			fmt.Printf("  Failed to sync configuration to %s: %v\n", dstBucket, err)
+			failed = append(failed, dstBucket)
+		}
+	}
+	verb := "Copied"
+	if *dryRun {
+		verb = "Would copy"
+	}
+	fmt.Printf("\n%s %d setting(s), %d could not be moved.\n", verb, counts["+"]+counts["~"], counts["!"])
+	if len(failed) > 0 {
+		log.Fatalf("Failed to sync configuration to %s.", strings.Join(failed, ", "))
+	}
+}
+
+// applyOptions are the switches that change how setup, apply and plan write a source's replication configuration.
+// Prune removes managed rules for destinations that are no longer listed; RefuseLegacyRules fails on legacy V1
+// rules instead of converting them. PropagationTimeout bounds how long calls failing while new roles and buckets
+// propagate are retried. SkipIAM leaves the replication role alone and expects it to exist already in Account,
+// which is then used instead of asking STS.
+type applyOptions struct {
+	Prune              bool
+	RefuseLegacyRules  bool
+	PropagationTimeout time.Duration
+	SkipIAM            bool
+	Account            string
+}
+
+// changeJournal records every change a run makes together with how to undo it, so a run failing halfway can
+// put back what it changed in reverse order. It is safe for concurrent use; a nil journal records nothing.
+type changeJournal struct {
+	mu      sync.Mutex
+	changes []journalEntry
+}
+
+// journalEntry is one recorded change.
+type journalEntry struct {
+	What string
+	Undo func() error
+}
+
+// record adds a change that undo reverts.
+func (j *changeJournal) record(what string, undo func() error) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.changes = append(j.changes, journalEntry{What: what, Undo: undo})
+}
+
+// rollback undoes the recorded changes, newest first. A change that cannot be undone is reported and the
+// rollback carries on with the older ones. It returns the number of changes that could not be undone.
+func (j *changeJournal) rollback() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fmt.Printf("\nRolling back %d change(s):\n", len(j.changes))
+	failed := 0
+	for i := len(j.changes) - 1; i >= 0; i-- {
+		c := j.changes[i]
+		if err := c.Undo(); err != nil {
+			fmt.Printf("  ❌ Could not undo: %s: %v\n", c.What, err)
+			failed++
+			continue
+		}
+		fmt.Printf("  ✅ Undone: %s\n", c.What)
+	}
+	j.changes = nil
+	return failed
+}
+
+// report lists the recorded changes that are left in place.
+func (j *changeJournal) report() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fmt.Printf("\nLeaving %d change(s) in place (--no-rollback):\n", len(j.changes))
+	for _, c := range j.changes {
+		fmt.Printf("  %s\n", c.What)
+	}
+}
+
+// failRun ends a run that failed with err, undoing the journal's changes first unless noRollback is set.
+func failRun(j *changeJournal, noRollback bool, format string, args ...interface{}) {
+	if len(j.changes) > 0 {
+		if noRollback {
+			j.report()
+		} else if failed := j.rollback(); failed > 0 {
+			fmt.Printf("%d change(s) could not be undone and must be reverted by hand.\n", failed)
+		}
+	}
+	log.Fatalf(format, args...)
+}
+
+// defaultPropagationTimeout is how long to retry by default; IAM changes usually propagate within seconds.
+const defaultPropagationTimeout = 2 * time.Minute
 
+// Error codes AWS returns while a new role, bucket or bucket setting has not propagated yet, by the call that sees them.
+// "Code:fragment" only matches errors with that code whose lowercased message contains fragment.
+var (
+	// PutBucketReplication: the role cannot be assumed yet, or the destination's versioning is not visible yet.
+	// S3 returns InvalidRequest for any invalid configuration too, so only these messages are retried.
+	replicationPropagationCodes = []string{"AccessDenied", "InvalidRequest:role", "InvalidRequest:versioning"}
+	// Creating, tagging and versioning a bucket right after it was created or deleted
+	bucketPropagationCodes = []string{s3.ErrCodeNoSuchBucket, "OperationAborted"}
+	// PutBucketPolicy: a new role is not yet accepted as a principal
+	bucketPolicyPropagationCodes = []string{"MalformedPolicy"}
+)
+
+// retryPropagation calls fn until it succeeds, fails with an error not matching codes, or timeout has
+// passed. Between attempts it sleeps with exponential backoff and full jitter. When fn had to be retried, the
+// time it took for the change to propagate is printed.
+func retryPropagation(what string, timeout time.Duration, codes []string, fn func() error) error {
+	start := time.Now()
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				fmt.Printf("%s succeeded after waiting %s for propagation (%d attempts).\n", what, time.Since(start).Round(100*time.Millisecond), attempt)
+			}
+			return nil
+		}
+		var aerr awserr.Error
+		retryable := false
+		if errors.As(err, &aerr) {
+			for _, c := range codes {
+				code, fragment, _ := strings.Cut(c, ":")
+				if aerr.Code() == code && strings.Contains(strings.ToLower(aerr.Message()), fragment) {
+					retryable = true
+				}
+			}
+		}
+		remaining := timeout - time.Since(start)
+		if !retryable || remaining <= 0 {
+			if retryable {
+				return fmt.Errorf("%s: still failing after %s: %w", what, timeout, err)
+			}
+			return err
+		}
+		sleep := time.Duration(rand.Int63n(int64(backoff)))
+		if sleep > remaining {
+			sleep = remaining
+		}
+		fmt.Printf("%s failed with %s, retrying in %s...\n", what, aerr.Code(), sleep.Round(100*time.Millisecond))
+		time.Sleep(sleep)
+		if backoff < 16*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// reconcileSource brings one source bucket and all of its destinations to the state described by src.
+// Every change is recorded in journal.
+func reconcileSource(sessionFor func(region, profile string) *session.Session, src SourceSpec, opts applyOptions, journal *changeJournal) error {
+	fmt.Printf("\nReconciling source %s (%s) with %d destination(s)\n", src.Bucket, src.Region, len(src.Destinations))
+	srcSess := sessionFor(src.Region, src.Profile)
 	s3Src := s3.New(srcSess)
-	s3Dst := s3.New(dstSess)
 	iamSvc := iam.New(srcSess) // IAM is global; region in session won't matter much
 
-	fmt.Printf("Setting up replication from %s (%s) -> %s (%s)\n", *srcBucket, *srcRegion, *dstBucket, *dstRegion)
+	if err := ensureBucketVersioning(s3Src, src.Bucket, journal); err != nil {
+		return fmt.Errorf("enable versioning on source bucket: %w", err)
+	}
+	fmt.Println("Versioning enabled on source bucket.")
+
+	lock, err := getObjectLockConfiguration(s3Src, src.Bucket)
+	if err != nil {
+		return fmt.Errorf("read Object Lock configuration of source bucket: %w", err)
+	}
+	if lock != nil {
+		src.ObjectLock = true
+		fmt.Printf("Source bucket has Object Lock enabled (%s); destinations must have it too.\n", describeRetention(lock))
+	}
+
+	if err := prepareDestinations(sessionFor, src.Destinations, lock, opts.PropagationTimeout, journal); err != nil {
+		return err
+	}
+
+	account := opts.Account
+	if !opts.SkipIAM {
+		if account, err = callerAccount(sts.New(srcSess)); err != nil {
+			return err
+		}
+	}
+	roleArn := roleArnFor(partitionFor(src.Region), account, src)
+	if opts.SkipIAM {
+		fmt.Printf("Skipping IAM; using replication role %s as it is.\n", roleArn)
+	} else {
+		if roleArn, err = ensureReplicationRole(iamSvc, src, account, opts.Prune, journal); err != nil {
+			return fmt.Errorf("ensure replication role: %w", err)
+		}
+		fmt.Printf("Replication role ready: %s\n", roleArn)
+	}
+
+	for _, dst := range src.Destinations {
+		if dst.Account == "" {
+			continue
+		}
+		s3Dst := s3.New(sessionFor(dst.Region, dst.Profile))
+		err := retryPropagation("Bucket policy of "+dst.Bucket, opts.PropagationTimeout, bucketPolicyPropagationCodes, func() error {
+			return ensureDestinationBucketPolicy(s3Dst, src.Bucket, dst, roleArn, journal)
+		})
+		if err != nil {
+			return fmt.Errorf("destination bucket policy for %s: %w", dst.Bucket, err)
+		}
+		fmt.Printf("Bucket policy on %s allows the replication role.\n", dst.Bucket)
+	}
+
+	if err := putReplicationConfiguration(s3Src, src, roleArn, opts, journal); err != nil {
+		return err
+	}
+	fmt.Printf("Replication configuration applied to %s.\n", src.Bucket)
+	return nil
+}
+
+// prepareDestinations creates the destination buckets that do not exist yet and enables versioning on all of
+// them, one goroutine per bucket. Calls failing while a new bucket propagates are retried for up to timeout.
+// When lock is set, the source has Object Lock enabled: new buckets are created with Object Lock and its default
+// retention, existing ones must already have Object Lock enabled and get the retention.
+// Created buckets and enabled versioning are recorded in journal.
+func prepareDestinations(sessionFor func(region, profile string) *session.Session, dests []DestinationSpec, lock *s3.ObjectLockConfiguration, timeout time.Duration, journal *changeJournal) error {
+	// Sessions are created up front, the session cache is not safe for concurrent use
+	clients := make([]*s3.S3, len(dests))
+	for i, dst := range dests {
+		clients[i] = s3.New(sessionFor(dst.Region, dst.Profile))
+	}
+	errs := make([]error, len(dests))
+	var wg sync.WaitGroup
+	for i, dst := range dests {
+		wg.Add(1)
+		go func(i int, dst DestinationSpec) {
+			defer wg.Done()
+			// Only the creation is retried as a whole: once an attempt created the bucket, a retry finds it
+			// existing, so created must survive the attempts and the defaults are applied separately below
+			created := false
+			err := retryPropagation("Creating bucket "+dst.Bucket, timeout, bucketPropagationCodes, func() error {
+				c, err := ensureBucketExists(clients[i], dst.Bucket, dst.Region, destinationDefaults(dst, lock))
+				created = created || c
+				return err
+			})
+			if created {
+				s3client, bucket := clients[i], dst.Bucket
+				journal.record(fmt.Sprintf("Created bucket %s (%s)", bucket, dst.Region), func() error {
+					return deleteBucket(s3client, bucket)
+				})
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("ensure destination bucket %s: %w", dst.Bucket, err)
+				return
+			}
+			if created {
+				if err := applyBucketDefaults(clients[i], dst.Bucket, destinationDefaults(dst, lock), timeout); err != nil {
+					errs[i] = fmt.Errorf("apply bucket defaults to destination bucket %s: %w", dst.Bucket, err)
+					return
+				}
+			}
+			// Deleting a bucket this run created also undoes its versioning
+			versioningJournal := journal
+			if created {
+				versioningJournal = nil
+			} else {
+				if lock != nil {
+					if err := ensureObjectLockRetention(clients[i], dst.Bucket, lock, journal); err != nil {
+						errs[i] = fmt.Errorf("destination bucket %s: %w", dst.Bucket, err)
+						return
+					}
+				}
+				drift, err := checkBucketDefaults(clients[i], dst.Bucket, destinationDefaults(dst, lock))
+				if err != nil {
+					errs[i] = fmt.Errorf("check settings of destination bucket %s: %w", dst.Bucket, err)
+					return
+				}
+				if len(drift) > 0 {
+					fmt.Printf("Warning: destination bucket %s differs from the bucket defaults:\n  %s\n", dst.Bucket, strings.Join(drift, "\n  "))
+				}
+			}
+			err = retryPropagation("Versioning of "+dst.Bucket, timeout, bucketPropagationCodes, func() error {
+				return ensureBucketVersioning(clients[i], dst.Bucket, versioningJournal)
+			})
+			if err != nil {
+				errs[i] = fmt.Errorf("enable versioning on destination bucket %s: %w", dst.Bucket, err)
+				return
+			}
+			fmt.Printf("Destination bucket %s (%s) exists/ready with versioning enabled.\n", dst.Bucket, dst.Region)
+		}(i, dst)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preflightCheck is one line of the preflight checklist.
+type preflightCheck struct {
+	Passed bool
+	Skip   bool // the check could not be made; does not fail the preflight
+	Name   string
+	Detail string
+}
+
+// preflightCaller is the identity behind one profile, and the IAM principal to simulate its policies for
+// ("" when they cannot be simulated, e.g. for the root user).
+type preflightCaller struct {
+	Account   string
+	Arn       string
+	Principal string
+	IAM       *iam.IAM
+}
+
+// runPreflight checks, without changing anything, that setting up sources can succeed: the credentials of every
+// profile involved work, every region is valid and enabled, every source bucket is reachable and the callers are
+// allowed to perform every action setup will perform. It prints a checklist and returns an error if any check failed.
+// With skipIAM, neither IAM nor STS is called: credentials, role actions and permissions are not checked and
+// regions are only checked to be valid.
+func runPreflight(sessionFor func(region, profile string) *session.Session, sources []SourceSpec, skipIAM bool) error {
+	var checks []preflightCheck
+	add := func(passed bool, name, detail string) {
+		checks = append(checks, preflightCheck{Passed: passed, Name: name, Detail: detail})
+	}
+
+	// Credentials, once per profile, checked against the first region they are used in
+	callers := make(map[string]*preflightCaller)
+	caller := func(region, profile string) *preflightCaller {
+		if skipIAM {
+			return nil
+		}
+		if c, ok := callers[profile]; ok {
+			return c
+		}
+		c, err := preflightIdentity(sessionFor(region, profile))
+		callers[profile] = c
+		if err != nil {
+			add(false, "Credentials of profile "+profileOr(profile, "(default)"), err.Error())
+			return nil
+		}
+		add(true, "Credentials of profile "+profileOr(profile, "(default)"), c.Arn)
+		return c
+	}
+
+	// Regions, once per region and profile; opt-in regions are enabled per account
+	regionsSeen := make(map[string]bool)
+	checkRegion := func(region, profile string) {
+		if regionsSeen[region+"|"+profile] {
+			return
+		}
+		regionsSeen[region+"|"+profile] = true
+		name := "Region " + region
+		if profile != "" {
+			name += " for profile " + profile
+		}
+		if skipIAM {
+			if err := checkRegionValid(region); err != nil {
+				add(false, name, err.Error())
+				return
+			}
+			add(true, name, "valid")
+			return
+		}
+		if err := checkRegionEnabled(sessionFor(region, profile), region); err != nil {
+			add(false, name, err.Error())
+			return
+		}
+		add(true, name, "valid and enabled")
+	}
+
+	// Actions each principal needs, by resource ARN
+	needed := make(map[*preflightCaller]map[string][]string)
+	need := func(c *preflightCaller, resource string, actions ...string) {
+		if c == nil {
+			return
+		}
+		if needed[c] == nil {
+			needed[c] = make(map[string][]string)
+		}
+		needed[c][resource] = append(needed[c][resource], actions...)
+	}
+
+	// A source that an earlier source replicates to is created by that source's setup if it does not exist yet,
+	// as with --bidirectional and in a mesh, so it is not required to exist
+	createdBy := make(map[string]string)
+	for _, src := range sources {
+		checkRegion(src.Region, src.Profile)
+		srcCaller := caller(src.Region, src.Profile)
+		s3Src := s3.New(sessionFor(src.Region, src.Profile))
+		var lock *s3.ObjectLockConfiguration
+		if creator, ok := createdBy[src.Bucket]; ok {
+			checks = append(checks, preflightCheck{Skip: true, Name: "Source bucket " + src.Bucket,
+				Detail: "not checked, created as a destination of " + creator + " if missing"})
+		} else {
+			exists, err := bucketExists(s3Src, src.Bucket)
+			switch {
+			case err != nil:
+				add(false, "Source bucket "+src.Bucket, err.Error())
+			case !exists:
+				add(false, "Source bucket "+src.Bucket, "does not exist")
+			default:
+				add(true, "Source bucket "+src.Bucket, "exists and is reachable")
+				if lock, err = getObjectLockConfiguration(s3Src, src.Bucket); err != nil {
+					add(false, "Object Lock of "+src.Bucket, err.Error())
+				}
+			}
+		}
+		for _, dst := range src.Destinations {
+			if _, ok := createdBy[dst.Bucket]; !ok {
+				createdBy[dst.Bucket] = src.Bucket
+			}
+		}
+
+		partition := partitionFor(src.Region)
+		need(srcCaller, bucketArn(partition, src.Bucket),
+			"s3:ListBucket", "s3:GetBucketVersioning", "s3:PutBucketVersioning", "s3:GetReplicationConfiguration", "s3:PutReplicationConfiguration",
+			"s3:GetBucketObjectLockConfiguration")
+		if srcCaller != nil {
+			roleArn := roleArnFor(partition, srcCaller.Account, src)
+			roleActions := []string{
+				"iam:GetRole", "iam:CreateRole", "iam:UpdateAssumeRolePolicy", "iam:PassRole",
+				"iam:ListRolePolicies", "iam:GetRolePolicy", "iam:PutRolePolicy", "iam:DeleteRolePolicy",
+				"iam:ListAttachedRolePolicies", "iam:AttachRolePolicy", "iam:DetachRolePolicy",
+			}
+			if len(src.RoleTags) > 0 {
+				roleActions = append(roleActions, "iam:TagRole")
+			}
+			if src.PermissionsBoundary != "" {
+				roleActions = append(roleActions, "iam:PutRolePermissionsBoundary")
+			}
+			need(srcCaller, roleArn, roleActions...)
+			// writeRolePolicy falls back to managed policies when the replication policy does not fit inline
+			need(srcCaller, policyArnFor(roleArn, managedPolicyName(src.Role, 1)),
+				"iam:GetPolicy", "iam:GetPolicyVersion", "iam:ListPolicyVersions", "iam:CreatePolicy",
+				"iam:CreatePolicyVersion", "iam:DeletePolicyVersion", "iam:DeletePolicy")
+		}
+
+		for _, dst := range src.Destinations {
+			checkRegion(dst.Region, dst.Profile)
+			dstCaller := caller(dst.Region, dst.Profile)
+			actions := []string{
+				"s3:ListBucket", "s3:CreateBucket", "s3:GetBucketVersioning", "s3:PutBucketVersioning",
+				"s3:GetBucketPublicAccessBlock", "s3:PutBucketPublicAccessBlock",
+				"s3:GetBucketOwnershipControls", "s3:PutBucketOwnershipControls",
+				"s3:GetEncryptionConfiguration", "s3:PutEncryptionConfiguration",
+				"s3:GetBucketTagging", "s3:PutBucketTagging",
+				"s3:GetBucketObjectLockConfiguration",
+			}
+			if lock != nil {
+				actions = append(actions, "s3:PutBucketObjectLockConfiguration")
+				// Existing destinations cannot take replicas of locked objects without Object Lock
+				s3Dst := s3.New(sessionFor(dst.Region, dst.Profile))
+				if exists, err := bucketExists(s3Dst, dst.Bucket); err == nil && exists {
+					dstLock, err := getObjectLockConfiguration(s3Dst, dst.Bucket)
+					switch {
+					case err != nil:
+						add(false, "Object Lock of "+dst.Bucket, err.Error())
+					case dstLock == nil:
+						add(false, "Object Lock of "+dst.Bucket, "not enabled, but source "+src.Bucket+" has Object Lock")
+					default:
+						add(true, "Object Lock of "+dst.Bucket, "enabled like on source "+src.Bucket)
+					}
+				}
+			}
+			if dst.Account != "" {
+				actions = append(actions, "s3:GetBucketPolicy", "s3:PutBucketPolicy")
+			}
+			need(dstCaller, bucketArn(partition, dst.Bucket), actions...)
+		}
+	}
+
+	// Simulate each principal's identity policies for everything it needs
+	var principals []*preflightCaller
+	for c := range needed {
+		principals = append(principals, c)
+	}
+	sort.Slice(principals, func(i, j int) bool { return principals[i].Arn < principals[j].Arn })
+	for _, c := range principals {
+		name := "Permissions of " + c.Arn
+		if c.Principal == "" {
+			checks = append(checks, preflightCheck{Skip: true, Name: name, Detail: "cannot be simulated for this kind of identity"})
+			continue
+		}
+		denied, total, err := simulatePermissions(c.IAM, c.Principal, needed[c])
+		if err != nil {
+			checks = append(checks, preflightCheck{Skip: true, Name: name, Detail: "could not simulate: " + err.Error()})
+			continue
+		}
+		if len(denied) > 0 {
+			add(false, name, fmt.Sprintf("%d of %d actions denied", len(denied), total))
+			for _, d := range denied {
+				add(false, "  "+d, "denied")
+			}
+			continue
+		}
+		add(true, name, fmt.Sprintf("all %d actions allowed", total))
+	}
+
+	if skipIAM {
+		checks = append(checks, preflightCheck{Skip: true, Name: "Credentials and permissions", Detail: "not checked with --skip-iam"})
+	}
+
+	fmt.Println("\nPreflight checks:")
+	failed := 0
+	for _, c := range checks {
+		status := "PASS"
+		switch {
+		case c.Skip:
+			status = "SKIP"
+		case !c.Passed:
+			status = "FAIL"
+			failed++
+		}
+		fmt.Printf("  [%s] %s: %s\n", status, c.Name, c.Detail)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d preflight check(s) failed, nothing was changed", failed)
+	}
+	fmt.Println("All preflight checks passed.")
+	return nil
+}
+
+// preflightIdentity returns the identity of the session's credentials. An assumed role's session ARN is mapped
+// back to the role, which is what policies are simulated for.
+func preflightIdentity(sess *session.Session) (*preflightCaller, error) {
+	out, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, fmt.Errorf("GetCallerIdentity failed: %w", err)
+	}
+	c := &preflightCaller{Account: aws.StringValue(out.Account), Arn: aws.StringValue(out.Arn), IAM: iam.New(sess)}
+	// arn:aws:iam::123456789012:user/name, arn:aws:sts::123456789012:assumed-role/name/session, arn:aws:iam::123456789012:root
+	parts := strings.SplitN(c.Arn, ":", 6)
+	if len(parts) != 6 {
+		return c, nil
+	}
+	resource := parts[5]
+	switch {
+	case strings.HasPrefix(resource, "user/"):
+		c.Principal = c.Arn
+	case strings.HasPrefix(resource, "assumed-role/"):
+		roleName := strings.Split(strings.TrimPrefix(resource, "assumed-role/"), "/")[0]
+		// The session ARN drops the role's path; GetRole has it, fall back to the root path
+		c.Principal = fmt.Sprintf("arn:%s:iam::%s:role/%s", parts[1], c.Account, roleName)
+		if role, err := getRole(c.IAM, roleName); err == nil && role != nil {
+			c.Principal = aws.StringValue(role.Arn)
+		}
+	}
+	return c, nil
+}
+
+// checkRegionEnabled checks that region is a valid region name and that it is enabled for the session's account,
+// by calling the region's own STS endpoint, which rejects requests for opt-in regions that are not enabled.
+func checkRegionEnabled(sess *session.Session, region string) error {
+	if err := checkRegionValid(region); err != nil {
+		return err
+	}
+	stsSvc := sts.New(sess, &aws.Config{STSRegionalEndpoint: endpoints.RegionalSTSEndpoint})
+	if _, err := stsSvc.GetCallerIdentity(&sts.GetCallerIdentityInput{}); err != nil {
+		return fmt.Errorf("not enabled for this account or unreachable: %w", err)
+	}
+	return nil
+}
+
+// checkRegionValid checks that region is a region name the SDK knows.
+func checkRegionValid(region string) error {
+	partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	if !ok {
+		return fmt.Errorf("%s is not a valid region", region)
+	}
+	if _, known := partition.Regions()[region]; !known {
+		return fmt.Errorf("%s is not a known region in partition %s", region, partition.ID())
+	}
+	return nil
+}
+
+// simulatePermissions evaluates the principal's identity policies for the actions on each resource ARN. It returns
+// the denied "action on resource" pairs and how many were evaluated. Resource policies such as bucket policies
+// are not taken into account.
+func simulatePermissions(iamSvc *iam.IAM, principal string, actions map[string][]string) ([]string, int, error) {
+	var denied []string
+	total := 0
+	resources := make([]string, 0, len(actions))
+	for r := range actions {
+		resources = append(resources, r)
+	}
+	sort.Strings(resources)
+	for _, resource := range resources {
+		unique := make(map[string]bool)
+		var names []*string
+		for _, a := range actions[resource] {
+			if !unique[a] {
+				unique[a] = true
+				names = append(names, aws.String(a))
+			}
+		}
+		input := &iam.SimulatePrincipalPolicyInput{
+			PolicySourceArn: aws.String(principal),
+			ActionNames:     names,
+			ResourceArns:    []*string{aws.String(resource)},
+		}
+		err := iamSvc.SimulatePrincipalPolicyPages(input, func(page *iam.SimulatePolicyResponse, lastPage bool) bool {
+			for _, r := range page.EvaluationResults {
+				total++
+				if aws.StringValue(r.EvalDecision) != "allowed" {
+					denied = append(denied, aws.StringValue(r.EvalActionName)+" on "+resource)
+				}
+			}
+			return !lastPage
+		})
+		if err != nil {
+			return nil, 0, fmt.Errorf("SimulatePrincipalPolicy failed: %w", err)
+		}
+	}
+	return denied, total, nil
+}
+
+// roleArnFor returns the ARN of the source's replication role in the given partition and account.
+func roleArnFor(partition, account string, src SourceSpec) string {
+	return fmt.Sprintf("arn:%s:iam::%s:role%s%s", partition, account, rolePathOrDefault(src.RolePath), src.Role)
+}
+
+// rolePathOrDefault returns the role path IAM uses when path is empty.
+func rolePathOrDefault(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// newSessionCache returns a function handing out one shared session per region and profile, using the endpoints
+// in ep. An empty profile selects defaultProfile.
+func newSessionCache(defaultProfile string, ep *endpointOptions) func(region, profile string) *session.Session {
+	sessions := make(map[string]*session.Session)
+	return func(region, profile string) *session.Session {
+		profile = profileOr(profile, defaultProfile)
+		key := region + "|" + profile
+		if sess, ok := sessions[key]; ok {
+			return sess
+		}
+		sessions[key] = newSession(region, profile, ep)
+		return sessions[key]
+	}
+}
+
+// planItem is one pending change: "+" create, "~" update, "-" remove, "!" drift that apply will not fix.
+type planItem struct {
+	Action   string
+	Resource string
+	Details  []string
+}
+
+// runPlan collects the current state and prints what setup (single pair) or apply (--topology) would change.
+// Nothing is mutated.
+func runPlan(args []string) {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	topologyPath := fs.String("topology", "", "Path to topology file; plans the whole topology like apply")
+	pair := addPairFlags(fs)
+	profile := fs.String("profile", "", "AWS profile to use (optional)")
+	refuseLegacy := fs.Bool("refuse-legacy-rules", false, "Report legacy V1 replication rules as blocking instead of planning their conversion")
+	skipIAM := fs.Bool("skip-iam", false, "Do not plan changes to the replication role, only refer to it; for endpoints without IAM")
+	account := fs.String("account", "", "Account ID the replication roles are in; required with --skip-iam, which then makes no STS calls")
+	ep := addEndpointFlags(fs)
+	fs.Parse(args)
+
+	// A single pair only adds or updates its own rule; a topology also prunes rules it no longer lists.
+	var topo *Topology
+	opts := applyOptions{Prune: true, RefuseLegacyRules: *refuseLegacy, SkipIAM: *skipIAM, Account: *account}
+	if *skipIAM && *account == "" {
+		log.Fatalf("--account must be provided with --skip-iam.")
+	}
+	if *topologyPath != "" {
+		t, err := loadTopology(*topologyPath)
+		if err != nil {
+			log.Fatalf("Failed to load topology: %v", err)
+		}
+		topo = t
+	} else {
+		if !pair.given() {
+			log.Fatalf("Either --topology or --source-bucket and --dest-bucket/--dest must be provided.")
+		}
+		sources, err := pair.sources()
+		if err != nil {
+			log.Fatalf("Invalid arguments: %v", err)
+		}
+		topo = &Topology{Sources: sources}
+		opts.Prune = false
+	}
+	if *profile != "" {
+		topo.Profile = *profile
+	}
+
+	sessionFor := newSessionCache(topo.Profile, ep)
+	counts := make(map[string]int)
+	for _, src := range topo.Sources {
+		items, err := planSource(sessionFor, src, opts)
+		if err != nil {
+			log.Fatalf("Failed to plan source %s: %v", src.Bucket, err)
+		}
+		fmt.Printf("\nPlan for source %s (%s):\n", src.Bucket, src.Region)
+		if len(items) == 0 {
+			fmt.Println("  No changes.")
+		}
+		for _, item := range items {
+			fmt.Printf("  %s %s\n", item.Action, item.Resource)
+			for _, d := range item.Details {
+				fmt.Printf("      %s\n", d)
+			}
+			counts[item.Action]++
+		}
+	}
+	fmt.Printf("\nPlan: %d to create, %d to change, %d to remove, %d warning(s). No changes were made.\n",
+		counts["+"], counts["~"], counts["-"], counts["!"])
+}
+
+// planSource compares the live state of one source, its destinations and its role with what apply would write.
+func planSource(sessionFor func(region, profile string) *session.Session, src SourceSpec, opts applyOptions) ([]planItem, error) {
+	srcSess := sessionFor(src.Region, src.Profile)
+	s3Src := s3.New(srcSess)
+	var items []planItem
+
+	// With --bidirectional the reverse source is the destination, which setup may still have to create
+	srcExists, err := bucketExists(s3Src, src.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	// Buckets and versioning
+	planVersioning := func(s3client *s3.S3, bucket string) error {
+		status, err := getBucketVersioningStatus(s3client, bucket)
+		if err != nil {
+			return fmt.Errorf("read versioning of %s: %w", bucket, err)
+		}
+		if status != "Enabled" {
+			items = append(items, planItem{"~", "versioning of " + bucket, []string{
+				fmt.Sprintf("Status: %s -> Enabled", valueOrNone(status)),
+			}})
+		}
+		return nil
+	}
+	var lock *s3.ObjectLockConfiguration
+	if srcExists {
+		if err := planVersioning(s3Src, src.Bucket); err != nil {
+			return nil, err
+		}
+		if lock, err = getObjectLockConfiguration(s3Src, src.Bucket); err != nil {
+			return nil, err
+		}
+	} else {
+		items = append(items, planItem{"+", fmt.Sprintf("bucket %s (%s)", src.Bucket, src.Region), []string{
+			"created as the destination of the other direction before this source is set up",
+		}})
+	}
+	src.ObjectLock = lock != nil
+	for _, dst := range src.Destinations {
+		s3Dst := s3.New(sessionFor(dst.Region, dst.Profile))
+		exists, err := bucketExists(s3Dst, dst.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			items = append(items, planItem{"+", fmt.Sprintf("bucket %s (%s)", dst.Bucket, dst.Region), destinationDefaults(dst, lock).describe()})
+			items = append(items, planItem{"~", "versioning of " + dst.Bucket, []string{"Status: (none) -> Enabled"}})
+			continue
+		}
+		if err := planVersioning(s3Dst, dst.Bucket); err != nil {
+			return nil, err
+		}
+		if lock != nil {
+			dstLock, err := getObjectLockConfiguration(s3Dst, dst.Bucket)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case dstLock == nil:
+				items = append(items, planItem{"!", "Object Lock of " + dst.Bucket, []string{
+					"not enabled although the source has Object Lock; apply will refuse this destination",
+				}})
+			case lock.Rule != nil && len(diffFields(dstLock.Rule, lock.Rule)) > 0:
+				items = append(items, planItem{"~", "Object Lock of " + dst.Bucket, diffFields(dstLock.Rule, lock.Rule)})
+			}
+		}
+		drift, err := checkBucketDefaults(s3Dst, dst.Bucket, destinationDefaults(dst, lock))
+		if err != nil {
+			return nil, fmt.Errorf("check settings of %s: %w", dst.Bucket, err)
+		}
+		if len(drift) > 0 {
+			items = append(items, planItem{"!", "settings of bucket " + dst.Bucket, drift})
+		}
+	}
+
+	// Role and inline policies
+	var roleArn string
+	if opts.SkipIAM {
+		roleArn = roleArnFor(partitionFor(src.Region), opts.Account, src)
+	} else {
+		roleItems, arn, err := planRole(iam.New(srcSess), src, opts)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, roleItems...)
+		roleArn = arn
+	}
+
+	// Bucket policies of destinations in other accounts
+	for _, dst := range src.Destinations {
+		if dst.Account == "" {
+			continue
+		}
+		current, err := getBucketPolicy(s3.New(sessionFor(dst.Region, dst.Profile)), dst.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		desired := mergeReplicationBucketPolicy(current, src.Bucket, dst, roleArn)
+		if current == nil {
+			items = append(items, planItem{"+", "bucket policy of " + dst.Bucket, diffFields(nil, desired)})
+		} else if changes := diffFields(current, desired); len(changes) > 0 {
+			items = append(items, planItem{"~", "bucket policy of " + dst.Bucket, changes})
+		}
+	}
+
+	// Replication rules
+	var existing *s3.ReplicationConfiguration
+	if srcExists {
+		if existing, err = getReplicationConfiguration(s3Src, src.Bucket); err != nil {
+			return nil, err
+		}
+	}
+	var existingRules []*s3.ReplicationRule
+	if existing != nil {
+		existingRules = existing.Rules
+	}
+	existingRules, converted, err := convertLegacyRules(existingRules, opts.RefuseLegacyRules)
+	if err != nil {
+		items = append(items, planItem{"!", "legacy V1 replication rules on " + src.Bucket + " block the update (--refuse-legacy-rules)", converted})
+		return items, nil
+	}
+	if len(converted) > 0 {
+		items = append(items, planItem{"~", "convert legacy V1 replication rules on " + src.Bucket, converted})
+	}
+	rules, err := buildReplicationRules(existingRules, src, opts.Prune)
+	if err != nil {
+		items = append(items, planItem{"!", "replication configuration of " + src.Bucket + " cannot be written", []string{err.Error()}})
+		return items, nil
+	}
+	desired := &s3.ReplicationConfiguration{
+		Role:  aws.String(roleArn),
+		Rules: rules,
+	}
+	if changes := diffReplicationConfiguration(existing, desired); len(changes) > 0 {
+		action := "~"
+		if existing == nil {
+			action = "+"
+		}
+		items = append(items, planItem{action, "replication configuration of " + src.Bucket, changes})
+	}
+	return items, nil
+}
+
+// planRole compares the source's replication role and its policies with what apply would write. It returns the
+// pending changes and the role's ARN, "(known after apply)" while the role does not exist.
+func planRole(iamSvc *iam.IAM, src SourceSpec, opts applyOptions) ([]planItem, string, error) {
+	var items []planItem
+	role, err := getRole(iamSvc, src.Role)
+	if err != nil {
+		return nil, "", err
+	}
+	roleArn := "(known after apply)"
+	if role == nil {
+		items = append(items, planItem{"+", "role " + src.Role, nil})
+	} else {
+		roleArn = aws.StringValue(role.Arn)
+		current, err := decodePolicyDocument(aws.StringValue(role.AssumeRolePolicyDocument))
+		if err != nil {
+			return nil, "", fmt.Errorf("trust policy of role %s: %w", src.Role, err)
+		}
+		account := strings.SplitN(roleArn, ":", 6)[4]
+		if changes := diffFields(current, desiredTrustPolicy(current, account, bucketArn(partitionFor(src.Region), src.Bucket))); len(changes) > 0 {
+			items = append(items, planItem{"~", "trust policy of role " + src.Role, changes})
+		}
+		if changes := roleSettingChanges(role, src); len(changes) > 0 {
+			items = append(items, planItem{"~", "settings of role " + src.Role, changes})
+		}
+	}
+	state := &rolePolicyState{Policy: map[string]interface{}{"Version": "2012-10-17", "Statement": []interface{}{}}}
+	var stale []string
+	if role != nil {
+		if state, err = getRolePolicyState(iamSvc, src.Role); err != nil {
+			return nil, "", err
+		}
+		if stale, err = stalePairPolicies(iamSvc, src.Role, src, opts.Prune); err != nil {
+			return nil, "", err
+		}
+	}
+	desiredPolicy := mergeRolePolicy(state.Policy, src, opts.Prune)
+	if changes := diffFields(state.Policy, desiredPolicy); len(changes) > 0 {
+		action := "~"
+		if !state.Inline && len(state.ManagedArns) == 0 {
+			action = "+"
+		}
+		if size := policySize(desiredPolicy); size > inlinePolicySizeLimit {
+			changes = append(changes, fmt.Sprintf("(%d characters, stored in managed policies)", size))
+		}
+		items = append(items, planItem{action, "replication policy of role " + src.Role, changes})
+	}
+	for _, name := range stale {
+		items = append(items, planItem{"-", "stale inline policy " + name, nil})
+	}
+	return items, roleArn, nil
+}
+
+// stdin is shared by all confirmation prompts.
+var stdin = bufio.NewReader(os.Stdin)
+
+// confirm asks the user to approve a destructive step unless assumeYes is set.
+func confirm(assumeYes bool, prompt string) bool {
+	if assumeYes {
+		return true
+	}
+	fmt.Printf("%s [y/N]: ", prompt)
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// runTeardown reverses what setup did for one source/destination pair.
+func runTeardown(args []string) {
+	fs := flag.NewFlagSet("teardown", flag.ExitOnError)
+	srcBucket := fs.String("source-bucket", "", "Source bucket name (required)")
+	srcRegion := fs.String("source-region", "us-east-1", "Source bucket region")
+	dstBucket := fs.String("dest-bucket", "", "Destination bucket name (required)")
+	dstRegion := fs.String("dest-region", "us-west-2", "Destination bucket region")
+	roleName := fs.String("role-name", "s3-replication-role-example", "IAM Role name for replication")
+	profile := fs.String("profile", "", "AWS profile to use (optional)")
+	renumber := fs.Bool("renumber-priorities", false, "Renumber the remaining rules' priorities 1..n instead of keeping them")
+	deleteDest := fs.Bool("delete-dest-bucket", false, "Empty and delete the destination bucket if this tool created it")
+	dstAccount := fs.String("dest-account", "", "Destination account ID if the destination bucket is owned by another account (optional)")
+	dstProfile := fs.String("dest-profile", "", "AWS profile for the destination account; defaults to --profile (optional)")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation before each destructive step")
+	skipIAM := fs.Bool("skip-iam", false, "Leave the replication role and its policy alone; for endpoints without IAM")
+	ep := addEndpointFlags(fs)
+	fs.Parse(args)
+
+	if *srcBucket == "" || *dstBucket == "" {
+		log.Fatalf("Both --source-bucket and --dest-bucket must be provided.")
+	}
+
+	srcSess := newSession(*srcRegion, *profile, ep)
+	s3Src := s3.New(srcSess)
+	iamSvc := iam.New(srcSess) // IAM is global; region in session won't matter much
+
+	fmt.Printf("Tearing down replication from %s (%s) -> %s (%s)\n", *srcBucket, *srcRegion, *dstBucket, *dstRegion)
+
+	// 1) Remove the replication rule for this destination
+	if err := removeReplicationRule(s3Src, *srcBucket, *dstBucket, *renumber, *yes); err != nil {
+		log.Fatalf("Failed to remove replication rule: %v", err)
+	}
+
+	// 2) Remove the inline policy for this pair, then the role once nothing is left on it
+	if *skipIAM {
+		fmt.Printf("Skipping IAM; role %s is left as it is.\n", *roleName)
+	} else if err := removeReplicationPolicy(iamSvc, *roleName, *srcBucket, *dstBucket, *yes); err != nil {
+		log.Fatalf("Failed to remove replication policy: %v", err)
+	}
+
+	s3Dst := s3.New(newSession(*dstRegion, profileOr(*dstProfile, *profile), ep))
+
+	// 3) Remove the cross-account bucket policy statements for this source
+	if *dstAccount != "" {
+		if err := removeDestinationBucketPolicy(s3Dst, *srcBucket, *dstBucket, *yes); err != nil {
+			log.Fatalf("Failed to remove destination bucket policy statements: %v", err)
+		}
+	}
+
+	// 4) Optionally empty and delete the destination bucket
+	if *deleteDest {
+		if err := deleteCreatedBucket(s3Dst, *dstBucket, *yes); err != nil {
+			log.Fatalf("Failed to delete destination bucket: %v", err)
+		}
+	}
+
+	fmt.Println("Teardown complete.")
+}
+
+// removeReplicationRule deletes the rules this tool manages for dstBucket from the source bucket's configuration.
+// The replication configuration is deleted entirely when no rules remain.
+func removeReplicationRule(s3client *s3.S3, srcBucket, dstBucket string, renumber, assumeYes bool) error {
+	existing, err := getReplicationConfiguration(s3client, srcBucket)
+	if err != nil {
+		return err
+	}
+	var remaining []*s3.ReplicationRule
+	var removed []string
+	if existing != nil {
+		for _, r := range existing.Rules {
+			if isManagedRuleFor(aws.StringValue(r.ID), dstBucket) {
+				removed = append(removed, aws.StringValue(r.ID))
+				continue
+			}
+			remaining = append(remaining, r)
+		}
+	}
+	if len(removed) == 0 {
+		fmt.Printf("No rule %s on %s, nothing to remove.\n", ruleIDFor(dstBucket, 0), srcBucket)
+		return nil
+	}
+	ruleID := strings.Join(removed, ", ")
+	if !confirm(assumeYes, fmt.Sprintf("Remove replication rule %s from %s?", ruleID, srcBucket)) {
+		fmt.Println("Skipped.")
+		return nil
+	}
+
+	if len(remaining) == 0 {
+		_, err := s3client.DeleteBucketReplication(&s3.DeleteBucketReplicationInput{Bucket: aws.String(srcBucket)})
+		if err != nil {
+			return fmt.Errorf("DeleteBucketReplication failed: %w", err)
+		}
+		fmt.Printf("Removed rule %s; %s has no replication rules left, configuration deleted.\n", ruleID, srcBucket)
+		return nil
+	}
+
+	if renumber {
+		sort.SliceStable(remaining, func(i, j int) bool {
+			return aws.Int64Value(remaining[i].Priority) < aws.Int64Value(remaining[j].Priority)
+		})
+		for i, r := range remaining {
+			r.Priority = aws.Int64(int64(i + 1))
+		}
+	}
+	_, err = s3client.PutBucketReplication(&s3.PutBucketReplicationInput{
+		Bucket: aws.String(srcBucket),
+		ReplicationConfiguration: &s3.ReplicationConfiguration{
+			Role:  existing.Role,
+			Rules: remaining,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("PutBucketReplication failed: %w", err)
+	}
+	fmt.Printf("Removed rule %s from %s; %d rule(s) remain.\n", ruleID, srcBucket, len(remaining))
+	return nil
+}
+
+// removeReplicationPolicy removes the permissions for the pair from the role's replication policy, along with the
+// pair's inline policy written by earlier versions, and deletes the role when it has no policies left.
+func removeReplicationPolicy(iamSvc *iam.IAM, roleName, srcBucket, dstBucket string, assumeYes bool) error {
+	role, err := getRole(iamSvc, roleName)
+	if err != nil {
+		return err
+	}
+	if role == nil {
+		fmt.Printf("Role %s does not exist, nothing to remove.\n", roleName)
+		return nil
+	}
+
+	state, err := getRolePolicyState(iamSvc, roleName)
+	if err != nil {
+		return err
+	}
+	remaining := removePairFromRolePolicy(state.Policy, srcBucket, dstBucket)
+	pair := SourceSpec{Bucket: srcBucket, Destinations: []DestinationSpec{{Bucket: dstBucket}}}
+	stale, err := stalePairPolicies(iamSvc, roleName, pair, false)
+	if err != nil {
+		return err
+	}
+	if len(stale) == 0 && len(diffFields(state.Policy, remaining)) == 0 {
+		fmt.Printf("No permissions for %s -> %s on role %s.\n", srcBucket, dstBucket, roleName)
+	} else if confirm(assumeYes, fmt.Sprintf("Remove the permissions for %s -> %s from role %s?", srcBucket, dstBucket, roleName)) {
+		if err := writeRolePolicy(iamSvc, roleName, aws.StringValue(role.Arn), state, remaining, stale); err != nil {
+			return err
+		}
+		fmt.Printf("Removed the permissions for %s -> %s.\n", srcBucket, dstBucket)
+	} else {
+		fmt.Println("Skipped.")
+	}
+
+	// The role is only removed once nothing else depends on it
+	inline, attached, err := countRolePolicies(iamSvc, roleName)
+	if err != nil {
+		return err
+	}
+	if inline > 0 || attached > 0 {
+		fmt.Printf("Role %s still has %d inline and %d attached policies, keeping it.\n", roleName, inline, attached)
+		return nil
+	}
+	if !confirm(assumeYes, fmt.Sprintf("Role %s has no policies left. Delete it?", roleName)) {
+		fmt.Println("Skipped.")
+		return nil
+	}
+	if _, err := iamSvc.DeleteRole(&iam.DeleteRoleInput{RoleName: aws.String(roleName)}); err != nil {
+		return fmt.Errorf("DeleteRole failed: %w", err)
+	}
+	fmt.Printf("Deleted role %s.\n", roleName)
+	return nil
+}
+
+// removeDestinationBucketPolicy drops the statements ensureDestinationBucketPolicy added for srcBucket.
+// The bucket policy is deleted when nothing else is left in it.
+func removeDestinationBucketPolicy(s3client *s3.S3, srcBucket, dstBucket string, assumeYes bool) error {
+	current, err := getBucketPolicy(s3client, dstBucket)
+	if err != nil {
+		return err
+	}
+	remaining := removeBucketPolicyStatements(current, replicationSids(srcBucket))
+	if current == nil || len(diffFields(current, remaining)) == 0 {
+		fmt.Printf("No replication statements for %s in the bucket policy of %s.\n", srcBucket, dstBucket)
+		return nil
+	}
+	if !confirm(assumeYes, fmt.Sprintf("Remove the replication statements for %s from the bucket policy of %s?", srcBucket, dstBucket)) {
+		fmt.Println("Skipped.")
+		return nil
+	}
+	if statements, _ := remaining["Statement"].([]interface{}); len(statements) == 0 {
+		if _, err := s3client.DeleteBucketPolicy(&s3.DeleteBucketPolicyInput{Bucket: aws.String(dstBucket)}); err != nil {
+			return fmt.Errorf("DeleteBucketPolicy failed: %w", err)
+		}
+		fmt.Printf("Deleted the bucket policy of %s.\n", dstBucket)
+		return nil
+	}
+	policyBytes, _ := json.Marshal(remaining)
+	_, err = s3client.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: aws.String(dstBucket),
+		Policy: aws.String(string(policyBytes)),
+	})
+	if err != nil {
+		return fmt.Errorf("PutBucketPolicy failed: %w", err)
+	}
+	fmt.Printf("Removed the replication statements from the bucket policy of %s.\n", dstBucket)
+	return nil
+}
+
+// countRolePolicies returns how many inline and managed policies are on the role.
+func countRolePolicies(iamSvc *iam.IAM, roleName string) (int, int, error) {
+	inline := 0
+	err := iamSvc.ListRolePoliciesPages(&iam.ListRolePoliciesInput{RoleName: aws.String(roleName)},
+		func(page *iam.ListRolePoliciesOutput, lastPage bool) bool {
+			inline += len(page.PolicyNames)
+			return !lastPage
+		})
+	if err != nil {
+		return 0, 0, fmt.Errorf("ListRolePolicies failed: %w", err)
+	}
+	attached := 0
+	err = iamSvc.ListAttachedRolePoliciesPages(&iam.ListAttachedRolePoliciesInput{RoleName: aws.String(roleName)},
+		func(page *iam.ListAttachedRolePoliciesOutput, lastPage bool) bool {
+			attached += len(page.AttachedPolicies)
+			return !lastPage
+		})
+	if err != nil {
+		return 0, 0, fmt.Errorf("ListAttachedRolePolicies failed: %w", err)
+	}
+	return inline, attached, nil
+}
+
+// deleteCreatedBucket empties and deletes a bucket, but only if ensureBucketExists created it.
+func deleteCreatedBucket(s3client *s3.S3, bucketName string, assumeYes bool) error {
+	exists, err := bucketExists(s3client, bucketName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		fmt.Printf("Bucket %s does not exist.\n", bucketName)
+		return nil
+	}
+	created, err := createdByTool(s3client, bucketName)
+	if err != nil {
+		return err
+	}
+	if !created {
+		fmt.Printf("Bucket %s was not created by this tool (no %s tag), keeping it.\n", bucketName, createdByTagKey)
+		return nil
+	}
+	if !confirm(assumeYes, fmt.Sprintf("Delete ALL object versions in %s and the bucket itself?", bucketName)) {
+		fmt.Println("Skipped.")
+		return nil
+	}
+	if err := deleteBucket(s3client, bucketName); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted bucket %s.\n", bucketName)
+	return nil
+}
+
+// deleteBucket deletes every object version in a bucket and then the bucket.
+func deleteBucket(s3client *s3.S3, bucketName string) error {
+	if err := emptyBucket(s3client, bucketName); err != nil {
+		return err
+	}
+	if _, err := s3client.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String(bucketName)}); err != nil {
+		return fmt.Errorf("DeleteBucket failed: %w", err)
+	}
+	return nil
+}
+
+// emptyBucket deletes every object version and delete marker in the bucket, one page (up to 1000 keys) at a time.
+func emptyBucket(s3client *s3.S3, bucketName string) error {
+	var deleteErr error
+	deleted := 0
+	err := s3client.ListObjectVersionsPages(&s3.ListObjectVersionsInput{Bucket: aws.String(bucketName)},
+		func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+			var objects []*s3.ObjectIdentifier
+			for _, v := range page.Versions {
+				objects = append(objects, &s3.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+			}
+			for _, m := range page.DeleteMarkers {
+				objects = append(objects, &s3.ObjectIdentifier{Key: m.Key, VersionId: m.VersionId})
+			}
+			if len(objects) == 0 {
+				return !lastPage
+			}
+			out, err := s3client.DeleteObjects(&s3.DeleteObjectsInput{
+				Bucket: aws.String(bucketName),
+				Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+			})
+			if err != nil {
+				deleteErr = fmt.Errorf("DeleteObjects failed: %w", err)
+				return false
+			}
+			if len(out.Errors) > 0 {
+				first := out.Errors[0]
+				deleteErr = fmt.Errorf("failed to delete %d object(s), first %s: %s",
+					len(out.Errors), aws.StringValue(first.Key), aws.StringValue(first.Message))
+				return false
+			}
+			deleted += len(objects)
+			return !lastPage
+		})
+	if err != nil {
+		return fmt.Errorf("ListObjectVersions failed: %w", err)
+	}
+	if deleteErr != nil {
+		return deleteErr
+	}
+	fmt.Printf("Deleted %d object version(s) from %s.\n", deleted, bucketName)
+	return nil
+}
+
+// ensureBucketExists creates a bucket if it doesn't exist, waits until it is visible, and reports whether it
+// created it. Only the Object Lock setting of defaults is used, as it can only be chosen at creation; the caller
+// applies the other defaults with applyBucketDefaults. For non-us-east-1 regions, LocationConstraint must be set.
+func ensureBucketExists(s3client *s3.S3, bucketName, region string, defaults bucketDefaults) (bool, error) {
+	// Check head bucket
+	_, err := s3client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucketName)})
+	if err == nil {
+		// exists and accessible
+		return false, nil
+	}
+
+	// If HeadBucket error indicates not found or forbidden, try to create
+	awsErr, ok := err.(awserr.Error)
+	if ok {
+		// If forbidden or not found, attempt create (it may fail if bucket owned by other account)
+		_ = awsErr
+	}
+
+	createInput := &s3.CreateBucketInput{
+		Bucket: aws.String(bucketName),
+	}
+	// For regions other than us-east-1 we must specify LocationConstraint
+	if region != "us-east-1" {
+		createInput.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(region),
+		}
+	}
+	if defaults.ObjectLock != nil {
+		// Also turns on versioning
+		createInput.ObjectLockEnabledForBucket = aws.Bool(true)
+	}
+	_, err = s3client.CreateBucket(createInput)
+	if err != nil {
+		// If bucket already exists and is owned by you, treat as ok; otherwise fail
+		if aerr, ok := err.(awserr.Error); ok {
+			if aerr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou {
+				return false, nil
+			}
+			if aerr.Code() == s3.ErrCodeBucketAlreadyExists {
+				return false, fmt.Errorf("bucket %s already exists and is owned by another account", bucketName)
+			}
+		}
+		return false, err
+	}
+
+	// Wait until bucket exists
+	err = s3client.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: aws.String(bucketName)})
+	if err != nil {
+		return true, fmt.Errorf("bucket creation started but wait failed: %w", err)
+	}
+	return true, nil
+}
+
+// bucketDefaults are the settings every bucket the tool creates gets: Block Public Access with all four settings
+// on, BucketOwnerEnforced object ownership (ACLs disabled), default encryption with KMSKeyArn, or SSE-S3 when it
+// is empty, and Tags. With ObjectLock, the bucket is created with Object Lock enabled and that configuration.
+type bucketDefaults struct {
+	KMSKeyArn  string
+	Tags       map[string]string
+	ObjectLock *s3.ObjectLockConfiguration
+}
+
+// destinationDefaults returns the defaults for a destination bucket; its replica key doubles as default key.
+// lock is the source bucket's Object Lock configuration, nil when it has none.
+func destinationDefaults(dst DestinationSpec, lock *s3.ObjectLockConfiguration) bucketDefaults {
+	return bucketDefaults{KMSKeyArn: dst.KMSKeyArn, Tags: dst.BucketTags, ObjectLock: lock}
+}
+
+// describe lists the defaults for output.
+func (d bucketDefaults) describe() []string {
+	encryption := "SSE-S3"
+	if d.KMSKeyArn != "" {
+		encryption = "SSE-KMS with " + d.KMSKeyArn
+	}
+	lines := []string{
+		"Block Public Access: all settings on",
+		"Object ownership: " + s3.ObjectOwnershipBucketOwnerEnforced,
+		"Default encryption: " + encryption,
+	}
+	if len(d.Tags) > 0 {
+		lines = append(lines, "Tags: "+tagFlag(d.Tags).String())
+	}
+	if d.ObjectLock != nil {
+		lines = append(lines, "Object Lock: "+describeRetention(d.ObjectLock))
+	}
+	return lines
+}
+
+// applyBucketDefaults configures a new bucket with the defaults. It also tags the bucket so teardown knows it
+// may delete it. Each setting is written on its own and retried for up to timeout while the new bucket
+// propagates, so one propagation error does not leave the remaining settings unapplied.
+func applyBucketDefaults(s3client *s3.S3, bucketName string, d bucketDefaults, timeout time.Duration) error {
+	bucket := aws.String(bucketName)
+	encryption := &s3.ServerSideEncryptionRule{
+		ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{SSEAlgorithm: aws.String(s3.ServerSideEncryptionAes256)},
+	}
+	if d.KMSKeyArn != "" {
+		encryption.ApplyServerSideEncryptionByDefault = &s3.ServerSideEncryptionByDefault{
+			SSEAlgorithm:   aws.String(s3.ServerSideEncryptionAwsKms),
+			KMSMasterKeyID: aws.String(d.KMSKeyArn),
+		}
+		encryption.BucketKeyEnabled = aws.Bool(true)
+	}
+	tagSet := []*s3.Tag{{Key: aws.String(createdByTagKey), Value: aws.String(createdByTagValue)}}
+	for _, k := range sortedKeys(d.Tags) {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(d.Tags[k])})
+	}
+
+	type step struct {
+		what string
+		put  func() error
+	}
+	steps := []step{
+		{"PutPublicAccessBlock", func() error {
+			_, err := s3client.PutPublicAccessBlock(&s3.PutPublicAccessBlockInput{
+				Bucket: bucket,
+				PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+					BlockPublicAcls:       aws.Bool(true),
+					IgnorePublicAcls:      aws.Bool(true),
+					BlockPublicPolicy:     aws.Bool(true),
+					RestrictPublicBuckets: aws.Bool(true),
+				},
+			})
+			return err
+		}},
+		{"PutBucketOwnershipControls", func() error {
+			_, err := s3client.PutBucketOwnershipControls(&s3.PutBucketOwnershipControlsInput{
+				Bucket: bucket,
+				OwnershipControls: &s3.OwnershipControls{Rules: []*s3.OwnershipControlsRule{
+					{ObjectOwnership: aws.String(s3.ObjectOwnershipBucketOwnerEnforced)},
+				}},
+			})
+			return err
+		}},
+		{"PutBucketEncryption", func() error {
+			_, err := s3client.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+				Bucket:                            bucket,
+				ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{Rules: []*s3.ServerSideEncryptionRule{encryption}},
+			})
+			return err
+		}},
+		{"PutBucketTagging", func() error {
+			_, err := s3client.PutBucketTagging(&s3.PutBucketTaggingInput{Bucket: bucket, Tagging: &s3.Tagging{TagSet: tagSet}})
+			return err
+		}},
+	}
+	if d.ObjectLock != nil && d.ObjectLock.Rule != nil {
+		steps = append(steps, step{"PutObjectLockConfiguration", func() error {
+			_, err := s3client.PutObjectLockConfiguration(&s3.PutObjectLockConfigurationInput{
+				Bucket:                  bucket,
+				ObjectLockConfiguration: &s3.ObjectLockConfiguration{ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled), Rule: d.ObjectLock.Rule},
+			})
+			return err
+		}})
+	}
+
+	for _, step := range steps {
+		if err := retryPropagation(step.what+" on "+bucketName, timeout, bucketPropagationCodes, step.put); err != nil {
+			return fmt.Errorf("%s failed: %w", step.what, err)
+		}
+	}
+	return nil
+}
+
+// checkBucketDefaults lists how an existing bucket's settings differ from the defaults. Tags the bucket has
+// besides the default ones are not reported.
+func checkBucketDefaults(s3client *s3.S3, bucketName string, d bucketDefaults) ([]string, error) {
+	var drift []string
+	notFound := func(err error, code string) bool {
+		aerr, ok := err.(awserr.Error)
+		return ok && aerr.Code() == code
+	}
+
+	pab, err := s3client.GetPublicAccessBlock(&s3.GetPublicAccessBlockInput{Bucket: aws.String(bucketName)})
+	switch {
+	case notFound(err, "NoSuchPublicAccessBlockConfiguration"):
+		drift = append(drift, "Block Public Access: not configured")
+	case err != nil:
+		return nil, fmt.Errorf("GetPublicAccessBlock failed: %w", err)
+	default:
+		c := pab.PublicAccessBlockConfiguration
+		if c == nil {
+			c = &s3.PublicAccessBlockConfiguration{}
+		}
+		settings := []struct {
+			name string
+			on   *bool
+		}{
+			{"BlockPublicAcls", c.BlockPublicAcls},
+			{"IgnorePublicAcls", c.IgnorePublicAcls},
+			{"BlockPublicPolicy", c.BlockPublicPolicy},
+			{"RestrictPublicBuckets", c.RestrictPublicBuckets},
+		}
+		for _, st := range settings {
+			if !aws.BoolValue(st.on) {
+				drift = append(drift, "Block Public Access: "+st.name+" is off")
+			}
+		}
+	}
+
+	ownership := ""
+	oc, err := s3client.GetBucketOwnershipControls(&s3.GetBucketOwnershipControlsInput{Bucket: aws.String(bucketName)})
+	if err != nil && !notFound(err, "OwnershipControlsNotFoundError") {
+		return nil, fmt.Errorf("GetBucketOwnershipControls failed: %w", err)
+	}
+	if err == nil && oc.OwnershipControls != nil && len(oc.OwnershipControls.Rules) > 0 {
+		ownership = aws.StringValue(oc.OwnershipControls.Rules[0].ObjectOwnership)
+	}
+	if ownership != s3.ObjectOwnershipBucketOwnerEnforced {
+		drift = append(drift, fmt.Sprintf("Object ownership: %s, expected %s", valueOrNone(ownership), s3.ObjectOwnershipBucketOwnerEnforced))
+	}
+
+	algorithm, key := "", ""
+	enc, err := s3client.GetBucketEncryption(&s3.GetBucketEncryptionInput{Bucket: aws.String(bucketName)})
+	if err != nil && !notFound(err, "ServerSideEncryptionConfigurationNotFoundError") {
+		return nil, fmt.Errorf("GetBucketEncryption failed: %w", err)
+	}
+	if err == nil && enc.ServerSideEncryptionConfiguration != nil {
+		for _, r := range enc.ServerSideEncryptionConfiguration.Rules {
+			if def := r.ApplyServerSideEncryptionByDefault; def != nil {
+				algorithm, key = aws.StringValue(def.SSEAlgorithm), aws.StringValue(def.KMSMasterKeyID)
+			}
+		}
+	}
+	if d.KMSKeyArn == "" && algorithm == "" {
+		drift = append(drift, "Default encryption: (none), expected SSE-S3 or SSE-KMS")
+	}
+	if d.KMSKeyArn != "" && (algorithm != s3.ServerSideEncryptionAwsKms || key != d.KMSKeyArn) {
+		drift = append(drift, fmt.Sprintf("Default encryption: %s %s, expected %s %s",
+			valueOrNone(algorithm), key, s3.ServerSideEncryptionAwsKms, d.KMSKeyArn))
+	}
+
+	if len(d.Tags) > 0 {
+		tags := make(map[string]string)
+		out, err := s3client.GetBucketTagging(&s3.GetBucketTaggingInput{Bucket: aws.String(bucketName)})
+		if err != nil && !notFound(err, "NoSuchTagSet") {
+			return nil, fmt.Errorf("GetBucketTagging failed: %w", err)
+		}
+		if err == nil {
+			for _, t := range out.TagSet {
+				tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+			}
+		}
+		for _, k := range sortedKeys(d.Tags) {
+			if v, ok := tags[k]; !ok || v != d.Tags[k] {
+				old := "(none)"
+				if ok {
+					old = v
+				}
+				drift = append(drift, fmt.Sprintf("Tags.%s: %s, expected %s", k, old, d.Tags[k]))
+			}
+		}
+	}
+	return drift, nil
+}
+
+// getObjectLockConfiguration returns the bucket's Object Lock configuration, or nil if Object Lock is not enabled.
+func getObjectLockConfiguration(s3client *s3.S3, bucketName string) (*s3.ObjectLockConfiguration, error) {
+	out, err := s3client.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{Bucket: aws.String(bucketName)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ObjectLockConfigurationNotFoundError" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("GetObjectLockConfiguration %s failed: %w", bucketName, err)
+	}
+	if out.ObjectLockConfiguration == nil || aws.StringValue(out.ObjectLockConfiguration.ObjectLockEnabled) != s3.ObjectLockEnabledEnabled {
+		return nil, nil
+	}
+	return out.ObjectLockConfiguration, nil
+}
+
+// describeRetention renders the default retention of an Object Lock configuration for output.
+func describeRetention(lock *s3.ObjectLockConfiguration) string {
+	if lock.Rule == nil || lock.Rule.DefaultRetention == nil {
+		return "no default retention"
+	}
+	r := lock.Rule.DefaultRetention
+	period := fmt.Sprintf("%d days", aws.Int64Value(r.Days))
+	if r.Years != nil {
+		period = fmt.Sprintf("%d years", aws.Int64Value(r.Years))
+	}
+	return fmt.Sprintf("default retention %s for %s", aws.StringValue(r.Mode), period)
+}
+
+// putObjectLockRetention sets the default retention of a bucket with Object Lock enabled.
+func putObjectLockRetention(s3client *s3.S3, bucketName string, rule *s3.ObjectLockRule) error {
+	_, err := s3client.PutObjectLockConfiguration(&s3.PutObjectLockConfigurationInput{
+		Bucket: aws.String(bucketName),
+		ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+			ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+			Rule:              rule,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("PutObjectLockConfiguration failed: %w", err)
+	}
+	return nil
+}
+
+// ensureObjectLockRetention refuses an existing destination without Object Lock for a source with Object Lock:
+// replicas of locked objects would lose their protection. A lock-enabled destination gets the source's default
+// retention if it differs; the change is recorded in journal. A destination retention is never removed.
+func ensureObjectLockRetention(s3client *s3.S3, bucketName string, lock *s3.ObjectLockConfiguration, journal *changeJournal) error {
+	current, err := getObjectLockConfiguration(s3client, bucketName)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("the source bucket has Object Lock enabled but %s does not; replicate to a bucket created with Object Lock", bucketName)
+	}
+	if lock.Rule == nil || len(diffFields(current.Rule, lock.Rule)) == 0 {
+		return nil
+	}
+	fmt.Printf("Setting Object Lock of %s to %s (was %s).\n", bucketName, describeRetention(lock), describeRetention(current))
+	if err := putObjectLockRetention(s3client, bucketName, lock.Rule); err != nil {
+		return err
+	}
+	journal.record("Changed default retention of "+bucketName, func() error {
+		return putObjectLockRetention(s3client, bucketName, current.Rule)
+	})
+	return nil
+}
+
+// bucketConfig is the bucket-level configuration sync-config copies from a source bucket to its destinations.
+// Empty fields are settings the source does not have. BlockPublicPolicy is set when the bucket's Block Public
+// Access settings reject public bucket policies; it is not copied, but decides what policy a destination takes.
+type bucketConfig struct {
+	Bucket             string
+	Region             string
+	Lifecycle          []*s3.LifecycleRule
+	CORS               []*s3.CORSRule
+	Policy             map[string]interface{}
+	Tags               map[string]string
+	IntelligentTiering []*s3.IntelligentTieringConfiguration
+	BlockPublicPolicy  bool
+}
+
+// Condition keys that name resources of one region; statements using them do not work in another region.
+var regionalConditionKeys = []string{"aws:SourceVpce", "aws:SourceVpc", "s3:x-amz-server-side-encryption-aws-kms-key-id"}
+
+// readBucketConfig reads the configuration sync-config copies from a bucket.
+func readBucketConfig(s3client *s3.S3, bucketName, region string) (*bucketConfig, error) {
+	cfg := &bucketConfig{Bucket: bucketName, Region: region, Tags: make(map[string]string)}
+	notFound := func(err error, code string) bool {
+		aerr, ok := err.(awserr.Error)
+		return ok && aerr.Code() == code
+	}
+
+	lc, err := s3client.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bucketName)})
+	if err != nil && !notFound(err, "NoSuchLifecycleConfiguration") {
+		return nil, fmt.Errorf("GetBucketLifecycleConfiguration failed: %w", err)
+	}
+	if err == nil {
+		cfg.Lifecycle = lc.Rules
+	}
+
+	cors, err := s3client.GetBucketCors(&s3.GetBucketCorsInput{Bucket: aws.String(bucketName)})
+	if err != nil && !notFound(err, "NoSuchCORSConfiguration") {
+		return nil, fmt.Errorf("GetBucketCors failed: %w", err)
+	}
+	if err == nil {
+		cfg.CORS = cors.CORSRules
+	}
+
+	if cfg.Policy, err = getBucketPolicy(s3client, bucketName); err != nil {
+		return nil, err
+	}
+
+	pab, err := s3client.GetPublicAccessBlock(&s3.GetPublicAccessBlockInput{Bucket: aws.String(bucketName)})
+	if err != nil && !notFound(err, "NoSuchPublicAccessBlockConfiguration") {
+		return nil, fmt.Errorf("GetPublicAccessBlock failed: %w", err)
+	}
+	if err == nil && pab.PublicAccessBlockConfiguration != nil {
+		cfg.BlockPublicPolicy = aws.BoolValue(pab.PublicAccessBlockConfiguration.BlockPublicPolicy)
+	}
+
+	tagging, err := s3client.GetBucketTagging(&s3.GetBucketTaggingInput{Bucket: aws.String(bucketName)})
+	if err != nil && !notFound(err, "NoSuchTagSet") {
+		return nil, fmt.Errorf("GetBucketTagging failed: %w", err)
+	}
+	if err == nil {
+		for _, t := range tagging.TagSet {
+			cfg.Tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+	}
+
+	input := &s3.ListBucketIntelligentTieringConfigurationsInput{Bucket: aws.String(bucketName)}
+	for {
+		out, err := s3client.ListBucketIntelligentTieringConfigurations(input)
+		if err != nil {
+			return nil, fmt.Errorf("ListBucketIntelligentTieringConfigurations failed: %w", err)
+		}
+		cfg.IntelligentTiering = append(cfg.IntelligentTiering, out.IntelligentTieringConfigurationList...)
+		if !aws.BoolValue(out.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = out.NextContinuationToken
+	}
+	return cfg, nil
+}
+
+// syncBucketConfig copies cfg to the destination bucket and returns what it changed, or with dryRun what it
+// would change. Settings the destination has and the source lacks are kept. Bucket policy statements that refer
+// to regional resources of the source region or that the destination's Block Public Access settings reject, a
+// bucket policy S3 refuses, and tags S3 reserves cannot be moved; they are reported with "!" and the remaining
+// settings are still copied.
+func syncBucketConfig(s3client *s3.S3, dstBucket, dstRegion string, cfg *bucketConfig, dryRun bool) ([]planItem, error) {
+	var items []planItem
+	change := func(action, resource string, details []string, apply func() error) error {
+		items = append(items, planItem{action, resource, details})
+		if dryRun || apply == nil {
+			return nil
+		}
+		return apply()
+	}
+	current, err := readBucketConfig(s3client, dstBucket, dstRegion)
+	if err != nil {
+		return nil, fmt.Errorf("read configuration of %s: %w", dstBucket, err)
+	}
+
+	if len(cfg.Lifecycle) > 0 {
+		rules := mergeByID(current.Lifecycle, cfg.Lifecycle, func(r *s3.LifecycleRule) string { return aws.StringValue(r.ID) })
+		if changes := diffFields(current.Lifecycle, rules); len(changes) > 0 {
+			err := change("~", "lifecycle rules of "+dstBucket, changes, func() error {
+				_, err := s3client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+					Bucket:                 aws.String(dstBucket),
+					LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: rules},
+				})
+				return err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("PutBucketLifecycleConfiguration failed: %w", err)
+			}
+		}
+	}
+
+	if len(cfg.CORS) > 0 {
+		rules := mergeByID(current.CORS, cfg.CORS, func(r *s3.CORSRule) string { return aws.StringValue(r.ID) })
+		if changes := diffFields(current.CORS, rules); len(changes) > 0 {
+			err := change("~", "CORS rules of "+dstBucket, changes, func() error {
+				_, err := s3client.PutBucketCors(&s3.PutBucketCorsInput{
+					Bucket:            aws.String(dstBucket),
+					CORSConfiguration: &s3.CORSConfiguration{CORSRules: rules},
+				})
+				return err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("PutBucketCors failed: %w", err)
+			}
+		}
+	}
+
+	if cfg.Policy != nil {
+		desired, skipped := bucketPolicyFor(cfg, current.Policy, dstBucket, dstRegion, current.BlockPublicPolicy)
+		for _, reason := range skipped {
+			items = append(items, planItem{"!", "bucket policy of " + dstBucket, []string{reason}})
+		}
+		statements, _ := desired["Statement"].([]interface{})
+		if changes := diffFields(current.Policy, desired); len(changes) > 0 && len(statements) > 0 {
+			err := change("~", "bucket policy of "+dstBucket, changes, func() error {
+				policyBytes, _ := json.Marshal(desired)
+				_, err := s3client.PutBucketPolicy(&s3.PutBucketPolicyInput{
+					Bucket: aws.String(dstBucket),
+					Policy: aws.String(string(policyBytes)),
+				})
+				return err
+			})
+			var aerr awserr.Error
+			if errors.As(err, &aerr) && (aerr.Code() == "AccessDenied" || aerr.Code() == "MalformedPolicy") {
+				// E.g. an account-level Block Public Access setting or a principal unknown in the destination's account
+				items[len(items)-1] = planItem{"!", "bucket policy of " + dstBucket, []string{"could not be copied: " + aerr.Message()}}
+			} else if err != nil {
+				return nil, fmt.Errorf("PutBucketPolicy failed: %w", err)
+			}
+		}
+	}
+
+	// Tags are merged into the destination's own, such as the created-by tag and the standard bucket tags
+	tags := make(map[string]string, len(current.Tags)+len(cfg.Tags))
+	for k, v := range current.Tags {
+		tags[k] = v
+	}
+	for _, k := range sortedKeys(cfg.Tags) {
+		switch {
+		case strings.HasPrefix(k, "aws:"):
+			items = append(items, planItem{"!", "tags of " + dstBucket, []string{fmt.Sprintf("tag %s is reserved by AWS and was not copied", k)}})
+		case k != createdByTagKey:
+			tags[k] = cfg.Tags[k]
+		}
+	}
+	if changes := diffFields(current.Tags, tags); len(changes) > 0 {
+		err := change("~", "tags of "+dstBucket, changes, func() error {
+			input := &s3.PutBucketTaggingInput{Bucket: aws.String(dstBucket), Tagging: &s3.Tagging{}}
+			for _, k := range sortedKeys(tags) {
+				input.Tagging.TagSet = append(input.Tagging.TagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+			}
+			_, err := s3client.PutBucketTagging(input)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("PutBucketTagging failed: %w", err)
+		}
+	}
+
+	existing := make(map[string]*s3.IntelligentTieringConfiguration, len(current.IntelligentTiering))
+	for _, c := range current.IntelligentTiering {
+		existing[aws.StringValue(c.Id)] = c
+	}
+	for _, c := range cfg.IntelligentTiering {
+		id := aws.StringValue(c.Id)
+		action := "~"
+		if existing[id] == nil {
+			action = "+"
+		}
+		changes := diffFields(existing[id], c)
+		if len(changes) == 0 {
+			continue
+		}
+		err := change(action, fmt.Sprintf("intelligent-tiering configuration %s of %s", id, dstBucket), changes, func() error {
+			_, err := s3client.PutBucketIntelligentTieringConfiguration(&s3.PutBucketIntelligentTieringConfigurationInput{
+				Bucket:                          aws.String(dstBucket),
+				Id:                              c.Id,
+				IntelligentTieringConfiguration: c,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("PutBucketIntelligentTieringConfiguration %s failed: %w", id, err)
+		}
+	}
+	return items, nil
+}
+
+// bucketPolicyFor merges the source's bucket policy into dstBucket's: ARNs of the source bucket and its objects
+// point at dstBucket instead, and a copied statement replaces the destination's statement with the same Sid.
+// The destination's other statements are kept. The source's replication statements are left out, as setup manages
+// those per bucket. When the destination is in another region, statements using regional condition keys or KMS keys
+// of the source region are left out, and with blockPublic so are statements granting public access. Why each
+// statement was left out is returned.
+func bucketPolicyFor(cfg *bucketConfig, dstPolicy map[string]interface{}, dstBucket, dstRegion string, blockPublic bool) (map[string]interface{}, []string) {
+	var copied []interface{}
+	var skipped []string
+	srcStatements, _ := cfg.Policy["Statement"].([]interface{})
+	for i, st := range srcStatements {
+		m, _ := st.(map[string]interface{})
+		sid, _ := m["Sid"].(string)
+		if strings.HasPrefix(sid, replicationSidBase) {
+			continue
+		}
+		if sid == "" {
+			sid = fmt.Sprintf("#%d", i+1)
+		}
+		if dstRegion != cfg.Region && refersToRegion(m, cfg.Region) {
+			skipped = append(skipped, fmt.Sprintf("statement %s refers to resources in %s and was not copied", sid, cfg.Region))
+			continue
+		}
+		if blockPublic && isPublicStatement(m) {
+			skipped = append(skipped, fmt.Sprintf("statement %s grants public access, which Block Public Access on %s forbids, and was not copied", sid, dstBucket))
+			continue
+		}
+		copied = append(copied, rewriteBucketArns(st, cfg.Bucket, dstBucket))
+	}
+	dstStatements, _ := dstPolicy["Statement"].([]interface{})
+	statements := mergeByID(dstStatements, copied, func(st interface{}) string {
+		m, _ := st.(map[string]interface{})
+		sid, _ := m["Sid"].(string)
+		return sid
+	})
+	policy := map[string]interface{}{"Version": "2012-10-17", "Statement": statements}
+	if v, ok := cfg.Policy["Version"]; ok {
+		policy["Version"] = v
+	}
+	return policy, skipped
+}
+
+// isPublicStatement reports whether a bucket policy statement grants access to everyone: it allows a wildcard
+// principal without any condition narrowing it down.
+func isPublicStatement(statement map[string]interface{}) bool {
+	if effect, _ := statement["Effect"].(string); effect != "Allow" || statement["Condition"] != nil {
+		return false
+	}
+	switch p := statement["Principal"].(type) {
+	case string:
+		return p == "*"
+	case map[string]interface{}:
+		return policyValueContains(p["AWS"], "*")
+	}
+	return false
+}
+
+// mergeByID merges desired entries into current ones: a desired entry replaces the current entry with the same ID
+// in place, and the remaining desired entries are appended. Current entries desired does not have are kept.
+// Entries without an ID are matched by content.
+func mergeByID[T any](current, desired []T, id func(T) string) []T {
+	replacements := make(map[string]T)
+	for _, d := range desired {
+		if key := id(d); key != "" {
+			replacements[key] = d
+		}
+	}
+	var merged []T
+	used := make(map[int]bool)
+	for _, c := range current {
+		key := id(c)
+		if d, ok := replacements[key]; ok && key != "" {
+			merged = append(merged, d)
+			delete(replacements, key)
+			continue
+		}
+		if key == "" {
+			for i, d := range desired {
+				if id(d) == "" && !used[i] && len(diffFields(c, d)) == 0 {
+					used[i] = true
+					break
+				}
+			}
+		}
+		merged = append(merged, c)
+	}
+	for i, d := range desired {
+		key := id(d)
+		if key == "" {
+			if !used[i] {
+				merged = append(merged, d)
+			}
+			continue
+		}
+		if r, pending := replacements[key]; pending {
+			merged = append(merged, r)
+			delete(replacements, key)
+		}
+	}
+	return merged
+}
+
+// refersToRegion reports whether a policy statement uses a regional condition key or a KMS key of region.
+func refersToRegion(statement map[string]interface{}, region string) bool {
+	data, _ := json.Marshal(statement)
+	doc := string(data)
+	if strings.Contains(doc, ":kms:"+region+":") {
+		return true
+	}
+	conditions, _ := statement["Condition"].(map[string]interface{})
+	for _, c := range conditions {
+		keys, _ := c.(map[string]interface{})
+		for key := range keys {
+			for _, regional := range regionalConditionKeys {
+				if strings.EqualFold(key, regional) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// rewriteBucketArns returns a copy of a decoded JSON value in which ARNs of srcBucket and its objects refer to
+// dstBucket instead, in any partition.
+func rewriteBucketArns(v interface{}, srcBucket, dstBucket string) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, child := range t {
+			out[k] = rewriteBucketArns(child, srcBucket, dstBucket)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, child := range t {
+			out[i] = rewriteBucketArns(child, srcBucket, dstBucket)
+		}
+		return out
+	case string:
+		// arn:<partition>:s3:::<bucket>[/<key>]
+		parts := strings.SplitN(t, ":", 6)
+		if len(parts) != 6 || parts[0] != "arn" || parts[2] != "s3" || parts[3] != "" || parts[4] != "" {
+			return t
+		}
+		if parts[5] == srcBucket || strings.HasPrefix(parts[5], srcBucket+"/") {
+			parts[5] = dstBucket + strings.TrimPrefix(parts[5], srcBucket)
+			return strings.Join(parts, ":")
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+// bucketFromArn returns the bucket name of an S3 bucket ARN in any partition, or "" if s is not one.
+func bucketFromArn(s string) string {
+	parsed, err := arn.Parse(s)
+	if err != nil || parsed.Service != "s3" || parsed.Resource == "" || strings.Contains(parsed.Resource, "/") {
+		return ""
+	}
+	return parsed.Resource
+}
+
+// getBucketRegion returns the region a bucket is in.
+func getBucketRegion(s3client *s3.S3, bucketName string) (string, error) {
+	out, err := s3client.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(bucketName)})
+	if err != nil {
+		return "", fmt.Errorf("GetBucketLocation %s failed: %w", bucketName, err)
+	}
+	switch region := aws.StringValue(out.LocationConstraint); region {
+	case "":
+		return "us-east-1", nil
+	case "EU":
+		// Buckets created with the old EU location constraint
+		return "eu-west-1", nil
+	default:
+		return region, nil
+	}
+}
+
+// Tag put on buckets created by ensureBucketExists.
+const (
+	createdByTagKey   = "crr-setup:created-by"
+	createdByTagValue = "s3_crr_setup"
+)
+
+// createdByTool reports whether the bucket carries the tag ensureBucketExists puts on buckets it creates.
+func createdByTool(s3client *s3.S3, bucketName string) (bool, error) {
+	out, err := s3client.GetBucketTagging(&s3.GetBucketTaggingInput{Bucket: aws.String(bucketName)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchTagSet" {
+			return false, nil
+		}
+		return false, fmt.Errorf("GetBucketTagging failed: %w", err)
+	}
+	for _, t := range out.TagSet {
+		if aws.StringValue(t.Key) == createdByTagKey && aws.StringValue(t.Value) == createdByTagValue {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// bucketExists reports whether the bucket exists and is accessible with the current credentials.
+func bucketExists(s3client *s3.S3, bucketName string) (bool, error) {
+	_, err := s3client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucketName)})
+	if err == nil {
+		return true, nil
+	}
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchBucket) {
+		return false, nil
+	}
+	return false, fmt.Errorf("HeadBucket %s failed: %w", bucketName, err)
+}
+
+// getBucketVersioningStatus returns "Enabled", "Suspended" or "" for a bucket that never had versioning.
+func getBucketVersioningStatus(s3client *s3.S3, bucketName string) (string, error) {
+	out, err := s3client.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String(bucketName)})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.Status), nil
+}
+
+// getBucketPolicy returns the bucket's policy document, or nil if it has none.
+func getBucketPolicy(s3client *s3.S3, bucketName string) (map[string]interface{}, error) {
+	out, err := s3client.GetBucketPolicy(&s3.GetBucketPolicyInput{Bucket: aws.String(bucketName)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NoSuchBucketPolicy" || aerr.Code() == s3.ErrCodeNoSuchBucket) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("GetBucketPolicy %s failed: %w", bucketName, err)
+	}
+	var policy map[string]interface{}
+	if err := json.Unmarshal([]byte(aws.StringValue(out.Policy)), &policy); err != nil {
+		return nil, fmt.Errorf("parse bucket policy of %s: %w", bucketName, err)
+	}
+	return policy, nil
+}
+
+// replicationSidBase starts the Sids of all bucket policy statements written for replication.
+const replicationSidBase = "CrrReplicationFrom"
+
+// replicationSidPrefix prefixes the Sids of the bucket policy statements written for replication from srcBucket.
+func replicationSidPrefix(srcBucket string) string {
+	return replicationSidBase + sidFor(srcBucket)
+}
+
+// replicationSids lists the Sids of the bucket policy statements written for replication from srcBucket,
+// including those written by earlier versions of this tool, which had no hash in the Sid.
+func replicationSids(srcBucket string) []string {
+	prefix, legacy := replicationSidPrefix(srcBucket), replicationSidBase+sidSafe(srcBucket)
+	return []string{prefix + "Objects", prefix + "Bucket", legacy + "Objects", legacy + "Bucket"}
+}
+
+// sidSafe drops the characters of a bucket name that are not allowed in a Sid.
+func sidSafe(bucket string) string {
+	var b strings.Builder
+	for _, c := range bucket {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// sidFor builds the Sid fragment for a bucket: its Sid-safe characters followed by a short hash of the full
+// name, so that names differing only in '-' or '.' (my-logs and mylogs) do not share a Sid.
+func sidFor(bucket string) string {
+	h := fnv.New32a()
+	h.Write([]byte(bucket))
+	return fmt.Sprintf("%s%08x", sidSafe(bucket), h.Sum32())
+}
+
+// mergeReplicationBucketPolicy returns policy with the statements allowing roleArn to replicate from srcBucket
+// into dst. Statements from an earlier run are recognised by their Sid and replaced; all others are kept.
+func mergeReplicationBucketPolicy(policy map[string]interface{}, srcBucket string, dst DestinationSpec, roleArn string) map[string]interface{} {
+	dstArn := bucketArn(partitionFor(dst.Region), dst.Bucket)
+	sid := replicationSidPrefix(srcBucket)
+	merged := removeBucketPolicyStatements(policy, replicationSids(srcBucket))
+	statements, _ := merged["Statement"].([]interface{})
+	principal := map[string]interface{}{"AWS": roleArn}
+	objectActions := []interface{}{"s3:ReplicateObject"}
+	if dst.DeleteMarkerReplication {
+		objectActions = append(objectActions, "s3:ReplicateDelete")
+	}
+	objectActions = append(objectActions, "s3:ReplicateTags", "s3:ObjectOwnerOverrideToBucketOwner")
+	statements = append(statements,
+		map[string]interface{}{
+			"Sid":       sid + "Objects",
+			"Effect":    "Allow",
+			"Principal": principal,
+			"Action":    objectActions,
+			"Resource":  dstArn + "/*",
+		},
+		map[string]interface{}{
+			"Sid":       sid + "Bucket",
+			"Effect":    "Allow",
+			"Principal": principal,
+			"Action": []interface{}{
+				"s3:List*",
+				"s3:GetBucketVersioning",
+				"s3:PutBucketVersioning",
+			},
+			"Resource": dstArn,
+		},
+	)
+	merged["Statement"] = statements
+	return merged
+}
+
+// removeBucketPolicyStatements returns a copy of policy without the statements with one of sids.
+// A nil policy yields an empty one.
+func removeBucketPolicyStatements(policy map[string]interface{}, sids []string) map[string]interface{} {
+	drop := make(map[string]bool, len(sids))
+	for _, sid := range sids {
+		drop[sid] = true
+	}
+	return filterPolicyStatements(policy, func(sid string) bool { return drop[sid] })
+}
+
+// filterPolicyStatements returns a copy of policy without the statements for whose Sid drop returns true.
+// The statements are always returned as a list. A nil policy yields an empty one.
+func filterPolicyStatements(policy map[string]interface{}, drop func(sid string) bool) map[string]interface{} {
+	out := map[string]interface{}{"Version": "2012-10-17"}
+	for k, v := range policy {
+		out[k] = v
+	}
+	var existing []interface{}
+	switch st := policy["Statement"].(type) {
+	case []interface{}:
+		existing = st
+	case map[string]interface{}:
+		existing = []interface{}{st}
+	}
+	statements := []interface{}{}
+	for _, st := range existing {
+		if m, ok := st.(map[string]interface{}); ok {
+			if sid, _ := m["Sid"].(string); drop(sid) {
+				continue
+			}
+		}
+		statements = append(statements, st)
+	}
+	out["Statement"] = statements
+	return out
+}
+
+// ensureDestinationBucketPolicy lets the replication role write replicas into a bucket owned by another account.
+// It must be called with the destination account's credentials.
+func ensureDestinationBucketPolicy(s3client *s3.S3, srcBucket string, dst DestinationSpec, roleArn string, journal *changeJournal) error {
+	dstBucket := dst.Bucket
+	current, err := getBucketPolicy(s3client, dstBucket)
+	if err != nil {
+		return err
+	}
+	desired := mergeReplicationBucketPolicy(current, srcBucket, dst, roleArn)
+	if current != nil && len(diffFields(current, desired)) == 0 {
+		return nil
+	}
+	policyBytes, _ := json.Marshal(desired)
+	_, err = s3client.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: aws.String(dstBucket),
+		Policy: aws.String(string(policyBytes)),
+	})
+	if err != nil {
+		return fmt.Errorf("PutBucketPolicy failed: %w", err)
+	}
+	journal.record("Updated bucket policy of "+dstBucket, func() error {
+		if current == nil {
+			_, err := s3client.DeleteBucketPolicy(&s3.DeleteBucketPolicyInput{Bucket: aws.String(dstBucket)})
+			return err
+		}
+		previous, _ := json.Marshal(current)
+		_, err := s3client.PutBucketPolicy(&s3.PutBucketPolicyInput{
+			Bucket: aws.String(dstBucket),
+			Policy: aws.String(string(previous)),
+		})
+		return err
+	})
+	return nil
+}
+
+// enableBucketVersioning enables versioning on the given bucket.
+func enableBucketVersioning(s3client *s3.S3, bucketName string) error {
+	_, err := s3client.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket: aws.String(bucketName),
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String("Enabled"),
+		},
+	})
+	return err
+}
+
+// ensureBucketVersioning enables versioning on a bucket and records it in journal if it was not enabled yet.
+// Versioning cannot be turned off again, so undoing it suspends versioning.
+func ensureBucketVersioning(s3client *s3.S3, bucketName string, journal *changeJournal) error {
+	status, err := getBucketVersioningStatus(s3client, bucketName)
+	if err != nil {
+		return err
+	}
+	if status == "Enabled" {
+		return nil
+	}
+	if err := enableBucketVersioning(s3client, bucketName); err != nil {
+		return err
+	}
+	journal.record("Enabled versioning on "+bucketName, func() error {
+		_, err := s3client.PutBucketVersioning(&s3.PutBucketVersioningInput{
+			Bucket:                  aws.String(bucketName),
+			VersioningConfiguration: &s3.VersioningConfiguration{Status: aws.String("Suspended")},
+		})
+		return err
+	})
+	return nil
+}
+
+// ensureReplicationRole creates (or returns existing) an IAM role for S3 replication and merges the permissions for
+// src and its destinations into the role's replication policy, which is shared by every source using the role.
+// With prune, permissions for destinations src no longer lists are dropped. The role's trust policy allows the
+// S3 service to assume it, but only on behalf of the source buckets using the role in account.
+// Every change to the role is recorded in journal.
+func ensureReplicationRole(iamSvc *iam.IAM, src SourceSpec, account string, prune bool, journal *changeJournal) (string, error) {
+	roleName := src.Role
+	srcArn := bucketArn(partitionFor(src.Region), src.Bucket)
+	assumePolicyBytes, _ := json.Marshal(trustPolicyDocument(account, []string{srcArn}))
+
+	input := &iam.CreateRoleInput{
+		RoleName:                 aws.String(roleName),
+		AssumeRolePolicyDocument: aws.String(string(assumePolicyBytes)),
+		Description:              aws.String("Role for S3 cross-region replication"),
+	}
+	if src.RolePath != "" {
+		input.Path = aws.String(src.RolePath)
+	}
+	if src.PermissionsBoundary != "" {
+		input.PermissionsBoundary = aws.String(src.PermissionsBoundary)
+	}
+	for _, k := range sortedKeys(src.RoleTags) {
+		input.Tags = append(input.Tags, &iam.Tag{Key: aws.String(k), Value: aws.String(src.RoleTags[k])})
+	}
+	createRoleOutput, err := iamSvc.CreateRole(input)
+	var roleArn string
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			// If role already exists, retrieve it
+			if aerr.Code() == iam.ErrCodeEntityAlreadyExistsException {
+				// Get role
+				out, gerr := iamSvc.GetRole(&iam.GetRoleInput{RoleName: aws.String(roleName)})
+				if gerr != nil {
+					return "", fmt.Errorf("role exists but failed to get role: %w", gerr)
+				}
+				roleArn = aws.StringValue(out.Role.Arn)
+				if err := reconcileTrustPolicy(iamSvc, out.Role, account, srcArn, journal); err != nil {
+					return "", err
+				}
+				if err := reconcileRoleSettings(iamSvc, out.Role, src, journal); err != nil {
+					return "", err
+				}
+			} else {
+				return "", fmt.Errorf("CreateRole error: %w", err)
+			}
+		} else {
+			return "", fmt.Errorf("CreateRole error: %w", err)
+		}
+	} else {
+		roleArn = aws.StringValue(createRoleOutput.Role.Arn)
+		journal.record("Created role "+roleName, func() error {
+			_, err := iamSvc.DeleteRole(&iam.DeleteRoleInput{RoleName: aws.String(roleName)})
+			return err
+		})
+	}
+
+	state, err := getRolePolicyState(iamSvc, roleName)
+	if err != nil {
+		return "", err
+	}
+	stale, err := stalePairPolicies(iamSvc, roleName, src, prune)
+	if err != nil {
+		return "", err
+	}
+	desired := mergeRolePolicy(state.Policy, src, prune)
+	changes := diffFields(state.Policy, desired)
+	if len(changes) > 0 && (state.Inline || len(state.ManagedArns) > 0) {
+		fmt.Printf("Updating replication policy of role %s:\n", roleName)
+		for _, c := range changes {
+			fmt.Printf("  %s\n", c)
+		}
+	}
+	if len(changes) > 0 || len(stale) > 0 {
+		// Recorded up front: writeRolePolicy takes several calls and may fail after some of them
+		if err := recordRolePolicy(iamSvc, roleName, roleArn, state, stale, journal); err != nil {
+			return "", err
+		}
+	}
+	if err := writeRolePolicy(iamSvc, roleName, roleArn, state, desired, stale); err != nil {
+		return "", err
+	}
+
+	return roleArn, nil
+}
+
+// reconcileTrustPolicy compares the trust policy of an existing role with the one it should have for the source
+// bucket srcArn and updates it, printing the changed fields, if they differ.
+func reconcileTrustPolicy(iamSvc *iam.IAM, role *iam.Role, account, srcArn string, journal *changeJournal) error {
+	roleName := aws.StringValue(role.RoleName)
+	current, err := decodePolicyDocument(aws.StringValue(role.AssumeRolePolicyDocument))
+	if err != nil {
+		return fmt.Errorf("trust policy of role %s: %w", roleName, err)
+	}
+	desired := desiredTrustPolicy(current, account, srcArn)
+	changes := diffFields(current, desired)
+	if len(changes) == 0 {
+		return nil
+	}
+	fmt.Printf("Updating trust policy of role %s:\n", roleName)
+	for _, c := range changes {
+		fmt.Printf("  %s\n", c)
+	}
+	policyBytes, _ := json.Marshal(desired)
+	_, err = iamSvc.UpdateAssumeRolePolicy(&iam.UpdateAssumeRolePolicyInput{
+		RoleName:       aws.String(roleName),
+		PolicyDocument: aws.String(string(policyBytes)),
+	})
+	if err != nil {
+		return fmt.Errorf("UpdateAssumeRolePolicy failed: %w", err)
+	}
+	journal.record("Updated trust policy of role "+roleName, func() error {
+		previous, _ := json.Marshal(current)
+		_, err := iamSvc.UpdateAssumeRolePolicy(&iam.UpdateAssumeRolePolicyInput{
+			RoleName:       aws.String(roleName),
+			PolicyDocument: aws.String(string(previous)),
+		})
+		return err
+	})
+	return nil
+}
+
+// roleSettingChanges lists how an existing role's permissions boundary and tags differ from src. Settings src
+// leaves empty are not compared, and tags not in src are kept.
+func roleSettingChanges(role *iam.Role, src SourceSpec) []string {
+	var changes []string
+	current := ""
+	if role.PermissionsBoundary != nil {
+		current = aws.StringValue(role.PermissionsBoundary.PermissionsBoundaryArn)
+	}
+	if src.PermissionsBoundary != "" && current != src.PermissionsBoundary {
+		changes = append(changes, fmt.Sprintf("PermissionsBoundary: %s -> %s", valueOrNone(current), src.PermissionsBoundary))
+	}
+	tags := make(map[string]string, len(role.Tags))
+	for _, t := range role.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	for _, k := range sortedKeys(src.RoleTags) {
+		if v, ok := tags[k]; !ok || v != src.RoleTags[k] {
+			old := "(none)"
+			if ok {
+				old = v
+			}
+			changes = append(changes, fmt.Sprintf("Tags.%s: %s -> %s", k, old, src.RoleTags[k]))
+		}
+	}
+	return changes
+}
+
+// reconcileRoleSettings brings the permissions boundary and tags of an existing role in line with src.
+// IAM cannot move a role to another path, so a different path is only reported.
+func reconcileRoleSettings(iamSvc *iam.IAM, role *iam.Role, src SourceSpec, journal *changeJournal) error {
+	roleName := aws.StringValue(role.RoleName)
+	if src.RolePath != "" && aws.StringValue(role.Path) != src.RolePath {
+		fmt.Printf("Warning: role %s has path %s, not %s; IAM cannot change the path of an existing role.\n",
+			roleName, aws.StringValue(role.Path), src.RolePath)
+	}
+	changes := roleSettingChanges(role, src)
+	if len(changes) == 0 {
+		return nil
+	}
+	fmt.Printf("Updating settings of role %s:\n", roleName)
+	for _, c := range changes {
+		fmt.Printf("  %s\n", c)
+	}
+	if src.PermissionsBoundary != "" && (role.PermissionsBoundary == nil ||
+		aws.StringValue(role.PermissionsBoundary.PermissionsBoundaryArn) != src.PermissionsBoundary) {
+		_, err := iamSvc.PutRolePermissionsBoundary(&iam.PutRolePermissionsBoundaryInput{
+			RoleName:            aws.String(roleName),
+			PermissionsBoundary: aws.String(src.PermissionsBoundary),
+		})
+		if err != nil {
+			return fmt.Errorf("PutRolePermissionsBoundary failed: %w", err)
+		}
+		previous := role.PermissionsBoundary
+		journal.record("Set permissions boundary of role "+roleName, func() error {
+			if previous == nil {
+				_, err := iamSvc.DeleteRolePermissionsBoundary(&iam.DeleteRolePermissionsBoundaryInput{RoleName: aws.String(roleName)})
+				return err
+			}
+			_, err := iamSvc.PutRolePermissionsBoundary(&iam.PutRolePermissionsBoundaryInput{
+				RoleName:            aws.String(roleName),
+				PermissionsBoundary: previous.PermissionsBoundaryArn,
+			})
+			return err
+		})
+	}
+	if len(src.RoleTags) > 0 {
+		input := &iam.TagRoleInput{RoleName: aws.String(roleName)}
+		for _, k := range sortedKeys(src.RoleTags) {
+			input.Tags = append(input.Tags, &iam.Tag{Key: aws.String(k), Value: aws.String(src.RoleTags[k])})
+		}
+		if _, err := iamSvc.TagRole(input); err != nil {
+			return fmt.Errorf("TagRole failed: %w", err)
+		}
+		// Put back the values the tags had, remove the ones that are new
+		restore := &iam.TagRoleInput{RoleName: aws.String(roleName)}
+		untag := &iam.UntagRoleInput{RoleName: aws.String(roleName)}
+		previous := make(map[string]*string, len(role.Tags))
+		for _, t := range role.Tags {
+			previous[aws.StringValue(t.Key)] = t.Value
+		}
+		for _, k := range sortedKeys(src.RoleTags) {
+			if v, ok := previous[k]; ok {
+				restore.Tags = append(restore.Tags, &iam.Tag{Key: aws.String(k), Value: v})
+			} else {
+				untag.TagKeys = append(untag.TagKeys, aws.String(k))
+			}
+		}
+		journal.record("Tagged role "+roleName, func() error {
+			if len(restore.Tags) > 0 {
+				if _, err := iamSvc.TagRole(restore); err != nil {
+					return err
+				}
+			}
+			if len(untag.TagKeys) > 0 {
+				if _, err := iamSvc.UntagRole(untag); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// callerAccount returns the account ID of the credentials in use.
+func callerAccount(stsSvc *sts.STS) (string, error) {
+	out, err := stsSvc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("GetCallerIdentity failed: %w", err)
+	}
+	return aws.StringValue(out.Account), nil
+}
+
+// getRole returns the role, or nil if it does not exist.
+func getRole(iamSvc *iam.IAM, roleName string) (*iam.Role, error) {
+	out, err := iamSvc.GetRole(&iam.GetRoleInput{RoleName: aws.String(roleName)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("GetRole %s failed: %w", roleName, err)
+	}
+	return out.Role, nil
+}
+
+// getRolePolicyDocument returns the decoded inline policy, or nil if the role has no policy with that name.
+func getRolePolicyDocument(iamSvc *iam.IAM, roleName, policyName string) (interface{}, error) {
+	out, err := iamSvc.GetRolePolicy(&iam.GetRolePolicyInput{
+		RoleName:   aws.String(roleName),
+		PolicyName: aws.String(policyName),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("GetRolePolicy %s failed: %w", policyName, err)
+	}
+	doc, err := decodePolicyDocument(aws.StringValue(out.PolicyDocument))
+	if err != nil {
+		return nil, fmt.Errorf("policy %s: %w", policyName, err)
+	}
+	return doc, nil
+}
+
+// decodePolicyDocument parses a policy document as returned by IAM, which URL-encodes it.
+func decodePolicyDocument(doc string) (interface{}, error) {
+	decoded, err := url.QueryUnescape(doc)
+	if err != nil {
+		return nil, fmt.Errorf("decode policy document: %w", err)
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(decoded), &v); err != nil {
+		return nil, fmt.Errorf("parse policy document: %w", err)
+	}
+	return v, nil
+}
+
+// trustPolicyDocument is the assume-role policy of the replication role. To protect against the confused deputy
+// problem, S3 may only assume the role on behalf of the given source buckets in account.
+func trustPolicyDocument(account string, sourceArns []string) map[string]interface{} {
+	return map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{
+			{
+				"Effect": "Allow",
+				"Principal": map[string]interface{}{
+					"Service": "s3.amazonaws.com",
+				},
+				"Action": "sts:AssumeRole",
+				"Condition": map[string]interface{}{
+					"StringEquals": map[string]interface{}{"aws:SourceAccount": account},
+					"ArnLike":      map[string]interface{}{"aws:SourceArn": sourceArns},
+				},
+			},
+		},
+	}
+}
+
+// desiredTrustPolicy is the trust policy a role should have once the source bucket srcArn uses it: the source
+// ARNs already in the current trust policy stay, so that sources sharing the role keep working. Only the statement
+// letting S3 assume the role is written; other statements, such as one for S3 Batch Operations, are kept as they are.
+func desiredTrustPolicy(current interface{}, account, srcArn string) map[string]interface{} {
+	arns := map[string]bool{srcArn: true}
+	doc, _ := current.(map[string]interface{})
+	statements, _ := doc["Statement"].([]interface{})
+	if st, ok := doc["Statement"].(map[string]interface{}); ok {
+		statements = []interface{}{st}
+	}
+	for _, st := range statements {
+		m, _ := st.(map[string]interface{})
+		if !isS3TrustStatement(m) {
+			continue
+		}
+		cond, _ := m["Condition"].(map[string]interface{})
+		arnLike, _ := cond["ArnLike"].(map[string]interface{})
+		switch v := arnLike["aws:SourceArn"].(type) {
+		case string:
+			arns[v] = true
+		case []interface{}:
+			for _, a := range v {
+				if s, ok := a.(string); ok {
+					arns[s] = true
+				}
+			}
+		}
+	}
+	list := make([]string, 0, len(arns))
+	for a := range arns {
+		list = append(list, a)
+	}
+	sort.Strings(list)
+	desired := trustPolicyDocument(account, list)
+
+	// The S3 statement takes the place of the first existing one; further S3 statements are merged into it
+	s3Statement := desired["Statement"].([]map[string]interface{})[0]
+	var merged []interface{}
+	placed := false
+	for _, st := range statements {
+		m, _ := st.(map[string]interface{})
+		if !isS3TrustStatement(m) {
+			merged = append(merged, st)
+			continue
+		}
+		if !placed {
+			merged = append(merged, s3Statement)
+			placed = true
+		}
+	}
+	if !placed {
+		merged = append([]interface{}{s3Statement}, merged...)
+	}
+	desired["Statement"] = merged
+	if v, ok := doc["Version"]; ok {
+		desired["Version"] = v
+	}
+	return desired
+}
+
+// isS3TrustStatement reports whether a trust policy statement lets the S3 service assume the role.
+func isS3TrustStatement(statement map[string]interface{}) bool {
+	if effect, _ := statement["Effect"].(string); effect != "Allow" {
+		return false
+	}
+	principal, _ := statement["Principal"].(map[string]interface{})
+	return policyValueContains(principal["Service"], "s3.amazonaws.com") && policyValueContains(statement["Action"], "sts:AssumeRole")
+}
+
+// policyValueContains reports whether a policy element, a string or a list of strings, contains s.
+func policyValueContains(v interface{}, s string) bool {
+	switch t := v.(type) {
+	case string:
+		return t == s
+	case []interface{}:
+		for _, e := range t {
+			if e == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bucketArn is the ARN of a bucket in partition.
+func bucketArn(partition, bucket string) string {
+	return fmt.Sprintf("arn:%s:s3:::%s", partition, bucket)
+}
+
+// partitionFor returns the partition of a region, e.g. aws, aws-cn or aws-us-gov. Every ARN the tool generates
+// is in the partition of the buckets' regions; replication never crosses partitions.
+func partitionFor(region string) string {
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return p.ID()
+	}
+	return endpoints.AwsPartitionID
+}
+
+// dnsSuffixFor returns the domain of the service endpoints in the partition of region, e.g. amazonaws.com.cn.
+func dnsSuffixFor(region string) string {
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return p.DNSSuffix()
+	}
+	return "amazonaws.com"
+}
+
+// replicationPolicyName is the inline policy earlier versions of this tool wrote for each src/dest bucket pair.
+// Such policies are replaced by the role's consolidated policy, see rolePolicyName.
+func replicationPolicyName(roleName, srcBucket, dstBucket string) string {
+	return fmt.Sprintf("%s-replication-%s-to-%s", roleName, srcBucket, dstBucket)
+}
+
+// IAM limits: all inline policies of a role together, and each managed policy, measured without whitespace.
+const (
+	inlinePolicySizeLimit  = 10240
+	managedPolicySizeLimit = 6144
+	maxManagedPolicies     = 10
+)
+
+// rolePolicyName is the inline policy holding the replication permissions of every source using the role.
+func rolePolicyName(roleName string) string {
+	return roleName + "-replication"
+}
+
+// managedPolicyName names the n-th customer-managed policy (from 1) used when the statements do not fit inline.
+func managedPolicyName(roleName string, n int) string {
+	return fmt.Sprintf("%s-replication-%d", roleName, n)
+}
+
+// The statements in a role's replication policy carry Sids built from the bucket names, so that the statements
+// of one source or one pair can be replaced or removed without touching the others: ReadFrom<src> and
+// ReadFrom<src>Kms for the source, Replicate<src>To<dst>, ...Owner and ...Kms for each destination.
+// Bucket names are lower case and sidFor adds a hash of the full name, so the capitalised words keep the Sids
+// unambiguous and buckets differing only in '-' or '.' get their own statements.
+// Earlier versions of this tool left out the hash; their statements are replaced by exact Sid.
+func readSid(srcBucket string) string {
+	return "ReadFrom" + sidFor(srcBucket)
+}
+
+func pairSid(srcBucket, dstBucket string) string {
+	return pairSidPrefix(srcBucket) + sidFor(dstBucket)
+}
+
+// pairSidPrefix starts the Sids of the statements for every destination of srcBucket.
+func pairSidPrefix(srcBucket string) string {
+	return "Replicate" + sidFor(srcBucket) + "To"
+}
+
+func legacyReadSid(srcBucket string) string {
+	return "ReadFrom" + sidSafe(srcBucket)
+}
+
+func legacyPairSid(srcBucket, dstBucket string) string {
+	return legacyPairSidPrefix(srcBucket) + sidSafe(dstBucket)
+}
+
+func legacyPairSidPrefix(srcBucket string) string {
+	return "Replicate" + sidSafe(srcBucket) + "To"
+}
+
+// sourcePolicyStatements are the role policy statements that allow S3 to replicate from src to all of its destinations.
+// They give S3 permissions to read the source object versions and write to the destination buckets.
+// When SSE-KMS replication is configured, they also allow decrypting with the source key and encrypting
+// with the destination key, but only through S3 in the respective region and for objects of these buckets.
+func sourcePolicyStatements(src SourceSpec) []interface{} {
+	read := readSid(src.Bucket)
+	partition := partitionFor(src.Region)
+	readActions := []string{
+		"s3:GetObjectVersion",
+		"s3:GetObjectVersionAcl",
+		"s3:GetObjectVersionTagging",
+		"s3:GetObjectVersionForReplication",
+		"s3:ListBucket",
+		"s3:GetReplicationConfiguration",
+	}
+	if src.ObjectLock {
+		// Retention and legal holds are replicated with locked objects
+		readActions = append(readActions, "s3:GetObjectRetention", "s3:GetObjectLegalHold")
+	}
+	statements := []interface{}{
+		map[string]interface{}{
+			"Sid":    read,
+			"Effect": "Allow",
+			"Action": readActions,
+			"Resource": []string{
+				bucketArn(partition, src.Bucket),
+				bucketArn(partition, src.Bucket) + "/*",
+			},
+		},
+	}
+	decrypt := false
+	for _, dst := range src.Destinations {
+		sid := pairSid(src.Bucket, dst.Bucket)
+		statements = append(statements, map[string]interface{}{
+			"Sid":    sid,
+			"Effect": "Allow",
+			"Action": destinationWriteActions(dst),
+			"Resource": []string{
+				bucketArn(partition, dst.Bucket),
+				bucketArn(partition, dst.Bucket) + "/*",
+			},
+		})
+		if dst.Account != "" {
+			// Needed to hand ownership of replicas to the destination account
+			statements = append(statements, map[string]interface{}{
+				"Sid":      sid + "Owner",
+				"Effect":   "Allow",
+				"Action":   []string{"s3:ObjectOwnerOverrideToBucketOwner"},
+				"Resource": []string{bucketArn(partition, dst.Bucket) + "/*"},
+			})
+		}
+		if src.KMSKeyArn != "" && dst.KMSKeyArn != "" {
+			statements = append(statements, kmsStatement(sid+"Kms", "kms:Encrypt", dst.KMSKeyArn, dst.Region, dst.Bucket))
+			decrypt = true
+		}
+	}
+	if decrypt {
+		statements = append(statements, kmsStatement(read+"Kms", "kms:Decrypt", src.KMSKeyArn, src.Region, src.Bucket))
+	}
+	return statements
+}
+
+// mergeRolePolicy returns policy with the statements for src and its destinations replaced by the current ones.
+// Statements of other sources and, unless prune is set, of destinations src no longer lists are kept.
+// Statements are sorted by Sid so that the document is stable between runs.
+func mergeRolePolicy(policy map[string]interface{}, src SourceSpec, prune bool) map[string]interface{} {
+	replaced := make(map[string]bool)
+	for _, read := range []string{readSid(src.Bucket), legacyReadSid(src.Bucket)} {
+		replaced[read], replaced[read+"Kms"] = true, true
+	}
+	for _, dst := range src.Destinations {
+		for _, sid := range []string{pairSid(src.Bucket, dst.Bucket), legacyPairSid(src.Bucket, dst.Bucket)} {
+			replaced[sid], replaced[sid+"Owner"], replaced[sid+"Kms"] = true, true, true
+		}
+	}
+	pairPrefix, legacyPrefix := pairSidPrefix(src.Bucket), legacyPairSidPrefix(src.Bucket)
+	merged := filterPolicyStatements(policy, func(sid string) bool {
+		return replaced[sid] || (prune && (strings.HasPrefix(sid, pairPrefix) || strings.HasPrefix(sid, legacyPrefix)))
+	})
+	statements, _ := merged["Statement"].([]interface{})
+	merged["Statement"] = sortStatements(append(statements, sourcePolicyStatements(src)...))
+	return merged
+}
+
+// removePairFromRolePolicy returns policy without the statements for srcBucket -> dstBucket. The source's read
+// statements go too once no other destination of srcBucket is left.
+func removePairFromRolePolicy(policy map[string]interface{}, srcBucket, dstBucket string) map[string]interface{} {
+	sid, legacy := pairSid(srcBucket, dstBucket), legacyPairSid(srcBucket, dstBucket)
+	out := filterPolicyStatements(policy, func(s string) bool {
+		return s == sid || s == sid+"Owner" || s == sid+"Kms" || s == legacy || s == legacy+"Owner" || s == legacy+"Kms"
+	})
+	pairPrefix, legacyPrefix := pairSidPrefix(srcBucket), legacyPairSidPrefix(srcBucket)
+	for _, st := range out["Statement"].([]interface{}) {
+		if m, ok := st.(map[string]interface{}); ok {
+			if s, _ := m["Sid"].(string); strings.HasPrefix(s, pairPrefix) || strings.HasPrefix(s, legacyPrefix) {
+				return out
+			}
+		}
+	}
+	read, legacyRead := readSid(srcBucket), legacyReadSid(srcBucket)
+	return filterPolicyStatements(out, func(s string) bool {
+		return s == read || s == read+"Kms" || s == legacyRead || s == legacyRead+"Kms"
+	})
+}
+
+// sortStatements orders policy statements by Sid.
+func sortStatements(statements []interface{}) []interface{} {
+	sid := func(st interface{}) string {
+		m, _ := st.(map[string]interface{})
+		s, _ := m["Sid"].(string)
+		return s
+	}
+	sort.SliceStable(statements, func(i, j int) bool { return sid(statements[i]) < sid(statements[j]) })
+	return statements
+}
+
+// policySize is the size IAM accounts a policy document with.
+func policySize(doc interface{}) int {
+	b, _ := json.Marshal(doc)
+	return len(b)
+}
+
+// rolePolicyState is what a role currently holds of its replication policy.
+type rolePolicyState struct {
+	Policy      map[string]interface{} // all replication statements, inline and managed together
+	Inline      bool                   // the inline policy exists
+	ManagedArns map[string]string      // attached managed replication policies by name
+	ManagedDocs map[string]interface{} // their current documents by name
+}
+
+// getRolePolicyState reads the replication statements of a role from its inline policy and from the
+// customer-managed policies attached to it.
+func getRolePolicyState(iamSvc *iam.IAM, roleName string) (*rolePolicyState, error) {
+	state := &rolePolicyState{ManagedArns: make(map[string]string), ManagedDocs: make(map[string]interface{})}
+	var statements []interface{}
+	collect := func(doc interface{}) {
+		m, _ := doc.(map[string]interface{})
+		statements = append(statements, filterPolicyStatements(m, func(string) bool { return false })["Statement"].([]interface{})...)
+	}
+
+	doc, err := getRolePolicyDocument(iamSvc, roleName, rolePolicyName(roleName))
+	if err != nil {
+		return nil, err
+	}
+	if doc != nil {
+		state.Inline = true
+		collect(doc)
+	}
+
+	err = iamSvc.ListAttachedRolePoliciesPages(&iam.ListAttachedRolePoliciesInput{RoleName: aws.String(roleName)},
+		func(page *iam.ListAttachedRolePoliciesOutput, lastPage bool) bool {
+			for _, p := range page.AttachedPolicies {
+				name := aws.StringValue(p.PolicyName)
+				if isManagedPolicyName(roleName, name) {
+					state.ManagedArns[name] = aws.StringValue(p.PolicyArn)
+				}
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return nil, fmt.Errorf("ListAttachedRolePolicies failed: %w", err)
+	}
+	for name, arn := range state.ManagedArns {
+		pol, err := iamSvc.GetPolicy(&iam.GetPolicyInput{PolicyArn: aws.String(arn)})
+		if err != nil {
+			return nil, fmt.Errorf("GetPolicy %s failed: %w", name, err)
+		}
+		ver, err := iamSvc.GetPolicyVersion(&iam.GetPolicyVersionInput{
+			PolicyArn: aws.String(arn),
+			VersionId: pol.Policy.DefaultVersionId,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("GetPolicyVersion %s failed: %w", name, err)
+		}
+		doc, err := decodePolicyDocument(aws.StringValue(ver.PolicyVersion.Document))
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %w", name, err)
+		}
+		state.ManagedDocs[name] = doc
+		collect(doc)
+	}
+	state.Policy = map[string]interface{}{"Version": "2012-10-17", "Statement": sortStatements(statements)}
+	return state, nil
+}
+
+// isManagedPolicyName reports whether name is one of the role's managed replication policies.
+func isManagedPolicyName(roleName, name string) bool {
+	n := strings.TrimPrefix(name, roleName+"-replication-")
+	if n == name || n == "" {
+		return false
+	}
+	for _, c := range n {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// stalePairPolicies lists the per-pair inline policies of earlier versions that the consolidated policy replaces:
+// those for the destinations of src, or with prune every one for src.
+func stalePairPolicies(iamSvc *iam.IAM, roleName string, src SourceSpec, prune bool) ([]string, error) {
+	wanted := make(map[string]bool)
+	for _, dst := range src.Destinations {
+		wanted[replicationPolicyName(roleName, src.Bucket, dst.Bucket)] = true
+	}
+	sourcePrefix := fmt.Sprintf("%s-replication-%s-to-", roleName, src.Bucket)
+	var stale []string
+	err := iamSvc.ListRolePoliciesPages(&iam.ListRolePoliciesInput{RoleName: aws.String(roleName)},
+		func(page *iam.ListRolePoliciesOutput, lastPage bool) bool {
+			for _, n := range page.PolicyNames {
+				name := aws.StringValue(n)
+				if wanted[name] || (prune && strings.HasPrefix(name, sourcePrefix)) {
+					stale = append(stale, name)
+				}
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return nil, fmt.Errorf("ListRolePolicies failed: %w", err)
+	}
+	return stale, nil
+}
+
+// splitPolicy packs the statements of policy into as few documents as fit the managed policy size limit.
+func splitPolicy(policy map[string]interface{}) ([]map[string]interface{}, error) {
+	var docs []map[string]interface{}
+	var current []interface{}
+	newDoc := func(statements []interface{}) map[string]interface{} {
+		return map[string]interface{}{"Version": "2012-10-17", "Statement": statements}
+	}
+	for _, st := range policy["Statement"].([]interface{}) {
+		if policySize(newDoc(append(current, st))) <= managedPolicySizeLimit {
+			current = append(current, st)
+			continue
+		}
+		if len(current) == 0 {
+			return nil, fmt.Errorf("statement %v alone exceeds the managed policy size limit of %d characters", st, managedPolicySizeLimit)
+		}
+		docs = append(docs, newDoc(current))
+		current = []interface{}{st}
+	}
+	if len(current) > 0 {
+		docs = append(docs, newDoc(current))
+	}
+	if len(docs) > maxManagedPolicies {
+		return nil, fmt.Errorf("the replication policy needs %d managed policies, more than the %d IAM attaches to a role by default", len(docs), maxManagedPolicies)
+	}
+	return docs, nil
+}
+
+// writeRolePolicy stores policy on the role. It becomes the inline policy rolePolicyName when it fits in IAM's
+// inline size limit together with the role's other inline policies; otherwise it is split across customer-managed
+// policies attached to the role. Replication policies that are no longer needed and the stale inline policies
+// are removed. An empty policy removes everything.
+func writeRolePolicy(iamSvc *iam.IAM, roleName, roleArn string, state *rolePolicyState, policy map[string]interface{}, stale []string) error {
+	for _, name := range stale {
+		_, err := iamSvc.DeleteRolePolicy(&iam.DeleteRolePolicyInput{RoleName: aws.String(roleName), PolicyName: aws.String(name)})
+		if err != nil {
+			return fmt.Errorf("failed to delete stale inline policy %s: %w", name, err)
+		}
+		fmt.Printf("Deleted stale inline policy %s.\n", name)
+	}
+
+	statements, _ := policy["Statement"].([]interface{})
+	if len(statements) == 0 {
+		if err := deleteInlineRolePolicy(iamSvc, roleName, state); err != nil {
+			return err
+		}
+		return detachManagedPolicies(iamSvc, roleName, state, 0)
+	}
+
+	otherInline, err := otherInlinePolicySize(iamSvc, roleName)
+	if err != nil {
+		return err
+	}
+	if policySize(policy)+otherInline <= inlinePolicySizeLimit {
+		if !state.Inline || len(diffFields(state.Policy, policy)) > 0 || len(state.ManagedArns) > 0 {
+			policyBytes, _ := json.Marshal(policy)
+			_, err := iamSvc.PutRolePolicy(&iam.PutRolePolicyInput{
+				RoleName:       aws.String(roleName),
+				PolicyName:     aws.String(rolePolicyName(roleName)),
+				PolicyDocument: aws.String(string(policyBytes)),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to put role policy: %w", err)
+			}
+		}
+		return detachManagedPolicies(iamSvc, roleName, state, 0)
+	}
+
+	docs, err := splitPolicy(policy)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Replication policy of %s exceeds the inline limit of %d characters, using %d managed policies.\n",
+		roleName, inlinePolicySizeLimit, len(docs))
+	for i, doc := range docs {
+		if err := putManagedPolicy(iamSvc, roleName, roleArn, managedPolicyName(roleName, i+1), doc, state); err != nil {
+			return err
+		}
+	}
+	if err := deleteInlineRolePolicy(iamSvc, roleName, state); err != nil {
+		return err
+	}
+	return detachManagedPolicies(iamSvc, roleName, state, len(docs))
+}
+
+// recordRolePolicy records in journal how to restore the role's replication policy in state and the stale
+// per-pair inline policies writeRolePolicy is about to replace. The replication statements are restored as a whole,
+// which may store them inline where they were split across managed policies before, or the other way round.
+func recordRolePolicy(iamSvc *iam.IAM, roleName, roleArn string, state *rolePolicyState, stale []string, journal *changeJournal) error {
+	staleDocs := make(map[string]interface{}, len(stale))
+	for _, name := range stale {
+		doc, err := getRolePolicyDocument(iamSvc, roleName, name)
+		if err != nil {
+			return err
+		}
+		staleDocs[name] = doc
+	}
+	journal.record("Updated replication policy of role "+roleName, func() error {
+		for _, name := range stale {
+			policyBytes, _ := json.Marshal(staleDocs[name])
+			_, err := iamSvc.PutRolePolicy(&iam.PutRolePolicyInput{
+				RoleName:       aws.String(roleName),
+				PolicyName:     aws.String(name),
+				PolicyDocument: aws.String(string(policyBytes)),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to restore inline policy %s: %w", name, err)
+			}
+		}
+		current, err := getRolePolicyState(iamSvc, roleName)
+		if err != nil {
+			return err
+		}
+		return writeRolePolicy(iamSvc, roleName, roleArn, current, state.Policy, nil)
+	})
+	return nil
+}
+
+// otherInlinePolicySize sums the sizes of the role's inline policies other than its replication policy.
+func otherInlinePolicySize(iamSvc *iam.IAM, roleName string) (int, error) {
+	var names []string
+	err := iamSvc.ListRolePoliciesPages(&iam.ListRolePoliciesInput{RoleName: aws.String(roleName)},
+		func(page *iam.ListRolePoliciesOutput, lastPage bool) bool {
+			for _, n := range page.PolicyNames {
+				if aws.StringValue(n) != rolePolicyName(roleName) {
+					names = append(names, aws.StringValue(n))
+				}
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return 0, fmt.Errorf("ListRolePolicies failed: %w", err)
+	}
+	size := 0
+	for _, name := range names {
+		doc, err := getRolePolicyDocument(iamSvc, roleName, name)
+		if err != nil {
+			return 0, err
+		}
+		size += policySize(doc)
+	}
+	return size, nil
+}
 
-	// 1) Create destination bucket if not exists
-	err := ensureBucketExists(s3Dst, *dstBucket, *dstRegion)
+// deleteInlineRolePolicy removes the role's inline replication policy if it has one.
+func deleteInlineRolePolicy(iamSvc *iam.IAM, roleName string, state *rolePolicyState) error {
+	if !state.Inline {
+		return nil
+	}
+	_, err := iamSvc.DeleteRolePolicy(&iam.DeleteRolePolicyInput{
+		RoleName:   aws.String(roleName),
+		PolicyName: aws.String(rolePolicyName(roleName)),
+	})
 	if err != nil {
-		log.Fatalf("Failed ensuring destination bucket: %v", err)
+		return fmt.Errorf("DeleteRolePolicy failed: %w", err)
 	}
-	fmt.Println("Destination bucket exists/ready.")
+	return nil
+}
 
-	// 2) Enable versioning on both buckets
-	if err := enableBucketVersioning(s3Src, *srcBucket); err != nil {
-		log.Fatalf("Failed enabling versioning on source bucket: %v", err)
+// putManagedPolicy creates the named managed policy with doc, or makes doc its new default version, and
+// attaches it to the role. IAM keeps at most five versions, so the oldest one is deleted when needed.
+func putManagedPolicy(iamSvc *iam.IAM, roleName, roleArn, name string, doc map[string]interface{}, state *rolePolicyState) error {
+	policyBytes, _ := json.Marshal(doc)
+	arn, exists := state.ManagedArns[name]
+	if exists && len(diffFields(state.ManagedDocs[name], doc)) == 0 {
+		return nil
 	}
-	fmt.Println("Versioning enabled on source bucket.")
+	if !exists {
+		out, err := iamSvc.CreatePolicy(&iam.CreatePolicyInput{
+			PolicyName:     aws.String(name),
+			PolicyDocument: aws.String(string(policyBytes)),
+			Description:    aws.String("S3 replication permissions of role " + roleName),
+		})
+		if err == nil {
+			arn = aws.StringValue(out.Policy.Arn)
+		} else if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeEntityAlreadyExistsException {
+			// Left over from an earlier run but detached; update it below
+			arn = policyArnFor(roleArn, name)
+			exists = true
+		} else {
+			return fmt.Errorf("CreatePolicy %s failed: %w", name, err)
+		}
+	}
+	if exists {
+		versions, err := iamSvc.ListPolicyVersions(&iam.ListPolicyVersionsInput{PolicyArn: aws.String(arn)})
+		if err != nil {
+			return fmt.Errorf("ListPolicyVersions %s failed: %w", name, err)
+		}
+		if len(versions.Versions) >= 5 {
+			var oldest *iam.PolicyVersion
+			for _, v := range versions.Versions {
+				if aws.BoolValue(v.IsDefaultVersion) {
+					continue
+				}
+				if oldest == nil || aws.TimeValue(v.CreateDate).Before(aws.TimeValue(oldest.CreateDate)) {
+					oldest = v
+				}
+			}
+			if oldest != nil {
+				_, err := iamSvc.DeletePolicyVersion(&iam.DeletePolicyVersionInput{PolicyArn: aws.String(arn), VersionId: oldest.VersionId})
+				if err != nil {
+					return fmt.Errorf("DeletePolicyVersion %s failed: %w", name, err)
+				}
+			}
+		}
+		_, err = iamSvc.CreatePolicyVersion(&iam.CreatePolicyVersionInput{
+			PolicyArn:      aws.String(arn),
+			PolicyDocument: aws.String(string(policyBytes)),
+			SetAsDefault:   aws.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("CreatePolicyVersion %s failed: %w", name, err)
+		}
+	}
+	_, err := iamSvc.AttachRolePolicy(&iam.AttachRolePolicyInput{RoleName: aws.String(roleName), PolicyArn: aws.String(arn)})
+	if err != nil {
+		return fmt.Errorf("AttachRolePolicy %s failed: %w", name, err)
+	}
+	fmt.Printf("Managed policy %s attached to %s.\n", name, roleName)
+	return nil
+}
 
-	if err := enableBucketVersioning(s3Dst, *dstBucket); err != nil {
-		log.Fatalf("Failed enabling versioning on destination bucket: %v", err)
+// policyArnFor builds the ARN of a customer-managed policy in the role's account and partition.
+func policyArnFor(roleArn, name string) string {
+	parts := strings.SplitN(roleArn, ":", 6)
+	if len(parts) != 6 {
+		return ""
 	}
-	fmt.Println("Versioning enabled on destination bucket.")
+	return fmt.Sprintf("arn:%s:iam::%s:policy/%s", parts[1], parts[4], name)
+}
 
-	// 3) Create IAM role for replication
-	roleArn, err := ensureReplicationRole(iamSvc, *roleName, *srcBucket, *dstBucket, *dstRegion)
-	if err != nil {
-		log.Fatalf("Failed to ensure IAM replication role: %v", err)
+// detachManagedPolicies detaches and deletes the role's managed replication policies numbered above keep.
+func detachManagedPolicies(iamSvc *iam.IAM, roleName string, state *rolePolicyState, keep int) error {
+	for name, arn := range state.ManagedArns {
+		n, _ := strconv.Atoi(strings.TrimPrefix(name, roleName+"-replication-"))
+		if n <= keep {
+			continue
+		}
+		if _, err := iamSvc.DetachRolePolicy(&iam.DetachRolePolicyInput{RoleName: aws.String(roleName), PolicyArn: aws.String(arn)}); err != nil {
+			return fmt.Errorf("DetachRolePolicy %s failed: %w", name, err)
+		}
+		// A policy can only be deleted once its non-default versions are gone
+		versions, err := iamSvc.ListPolicyVersions(&iam.ListPolicyVersionsInput{PolicyArn: aws.String(arn)})
+		if err != nil {
+			return fmt.Errorf("ListPolicyVersions %s failed: %w", name, err)
+		}
+		for _, v := range versions.Versions {
+			if aws.BoolValue(v.IsDefaultVersion) {
+				continue
+			}
+			if _, err := iamSvc.DeletePolicyVersion(&iam.DeletePolicyVersionInput{PolicyArn: aws.String(arn), VersionId: v.VersionId}); err != nil {
+				return fmt.Errorf("DeletePolicyVersion %s failed: %w", name, err)
+			}
+		}
+		if _, err := iamSvc.DeletePolicy(&iam.DeletePolicyInput{PolicyArn: aws.String(arn)}); err != nil {
+			return fmt.Errorf("DeletePolicy %s failed: %w", name, err)
+		}
+		fmt.Printf("Deleted managed policy %s.\n", name)
 	}
-	fmt.Printf("Replication role ready: %s\n", roleArn)
+	return nil
+}
 
-	// 4) Put replication configuration on source bucket
-	if err := putReplicationConfiguration(s3Src, *srcBucket, *dstBucket, roleArn); err != nil {
-		log.Fatalf("Failed to put replication configuration: %v", err)
+// destinationWriteActions lists what the role may do in the destination bucket.
+// s3:ReplicateDelete is only granted when delete markers are replicated to that destination.
+func destinationWriteActions(dst DestinationSpec) []string {
+	actions := []string{"s3:ReplicateObject"}
+	if dst.DeleteMarkerReplication {
+		actions = append(actions, "s3:ReplicateDelete")
 	}
-	fmt.Println("Replication configuration applied to source bucket.")
+	return append(actions,
+		"s3:ReplicateTags",
+		"s3:PutObjectAcl",
+		"s3:PutObjectVersionAcl",
+		"s3:PutObjectVersionTagging",
+		"s3:PutObject",
+	)
+}
 
-	fmt.Println("Cross-region replication setup complete.")
+// kmsStatement allows action on key only when S3 in region calls KMS for an object of bucket.
+// The bucket ARN itself is included in the encryption context for buckets using S3 Bucket Keys.
+func kmsStatement(sid, action, keyArn, region, bucket string) map[string]interface{} {
+	return map[string]interface{}{
+		"Sid":      sid,
+		"Effect":   "Allow",
+		"Action":   []string{action},
+		"Resource": []string{keyArn},
+		"Condition": map[string]interface{}{
+			"StringLike": map[string]interface{}{
+				"kms:ViaService": fmt.Sprintf("s3.%s.%s", region, dnsSuffixFor(region)),
+				"kms:EncryptionContext:aws:s3:arn": []string{
+					bucketArn(partitionFor(region), bucket),
+					bucketArn(partitionFor(region), bucket) + "/*",
+				},
+			},
+		},
+	}
 }
 
-// ensureBucketExists creates a bucket if it doesn't exist.
-// For non-us-east-1 regions, LocationConstraint must be set.
-func ensureBucketExists(s3client *s3.S3, bucketName, region string) error {
-	// Check head bucket
-	_, err := s3client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucketName)})
-	if err == nil {
-		// exists and accessible
-		return nil
+// managedRulePrefix marks replication rules created by this tool. Rules with other IDs are left alone.
+const managedRulePrefix = "replicate-to-"
+
+// ruleIDFor returns the ID of the index-th rule this tool manages for a destination bucket.
+// The first rule is replicate-to-<bucket>; further filters get a /2, /3... suffix, which no bucket name contains.
+func ruleIDFor(dstBucket string, index int) string {
+	if index == 0 {
+		return managedRulePrefix + dstBucket
 	}
+	return fmt.Sprintf("%s%s/%d", managedRulePrefix, dstBucket, index+1)
+}
 
-	// If HeadBucket error indicates not found or forbidden, try to create
-	awsErr, ok := err.(awserr.Error)
-	if ok {
-		// If forbidden or not found, attempt create (it may fail if bucket owned by other account)
-		_ = awsErr
+// isManagedRuleFor reports whether id is one of the rules this tool manages for dstBucket.
+func isManagedRuleFor(id, dstBucket string) bool {
+	base := managedRulePrefix + dstBucket
+	return id == base || strings.HasPrefix(id, base+"/")
+}
+
+// putReplicationConfiguration configures the replication rules for every destination of src on the source bucket.
+// Rules for other destinations are kept unless opts.Prune is set, in which case rules previously created by
+// this tool for destinations no longer listed are removed. Legacy V1 rules are converted to V2 first, as AWS
+// rejects configurations mixing both, unless opts.RefuseLegacyRules is set. Nothing is written if the
+// configuration is unchanged.
+func putReplicationConfiguration(s3client *s3.S3, src SourceSpec, roleArn string, opts applyOptions, journal *changeJournal) error {
+	srcBucket := src.Bucket
+	// Get existing replication configuration
+	existing, err := getReplicationConfiguration(s3client, srcBucket)
+	if err != nil {
+		return err
 	}
 
-	createInput := &s3.CreateBucketInput{
-		Bucket: aws.String(bucketName),
+	var existingRules []*s3.ReplicationRule
+	if existing != nil {
+		existingRules = existing.Rules
 	}
-	// For regions other than us-east-1 we must specify LocationConstraint
-	if region != "us-east-1" {
-		createInput.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
-			LocationConstraint: aws.String(region),
+	existingRules, converted, err := convertLegacyRules(existingRules, opts.RefuseLegacyRules)
+	if err != nil {
+		return fmt.Errorf("%s %w (%s); convert them or run without --refuse-legacy-rules", srcBucket, err, strings.Join(converted, "; "))
+	}
+	if len(converted) > 0 {
+		fmt.Printf("Converting legacy V1 replication rules on %s to V2:\n", srcBucket)
+		for _, c := range converted {
+			fmt.Printf("  %s\n", c)
 		}
 	}
-	_, err = s3client.CreateBucket(createInput)
+	rules, err := buildReplicationRules(existingRules, src, opts.Prune)
 	if err != nil {
-		// If bucket already exists and is owned by you, treat as ok; otherwise fail
-		if aerr, ok := err.(awserr.Error); ok {
-			if aerr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou {
-				return nil
-			}
-			if aerr.Code() == s3.ErrCodeBucketAlreadyExists {
-				return fmt.Errorf("bucket %s already exists and is owned by another account", bucketName)
-			}
-		}
 		return err
 	}
+	configuration := &s3.ReplicationConfiguration{
+		Role:  aws.String(roleArn),
+		Rules: rules,
+	}
+	changes := diffReplicationConfiguration(existing, configuration)
+	if len(changes) == 0 {
+		fmt.Printf("Replication configuration on %s already up to date.\n", srcBucket)
+		return nil
+	}
+	for _, c := range changes {
+		fmt.Printf("  %s\n", c)
+	}
 
-	// Wait until bucket exists
-	err = s3client.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: aws.String(bucketName)})
+	// A role created or changed moments ago may not be usable by S3 yet
+	err = retryPropagation("PutBucketReplication on "+srcBucket, opts.PropagationTimeout, replicationPropagationCodes, func() error {
+		_, err := s3client.PutBucketReplication(&s3.PutBucketReplicationInput{
+			Bucket:                   aws.String(srcBucket),
+			ReplicationConfiguration: configuration,
+		})
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("bucket creation started but wait failed: %w", err)
+		return fmt.Errorf("PutBucketReplication failed: %w", err)
 	}
+	journal.record("Updated replication configuration of "+srcBucket, func() error {
+		if existing == nil {
+			_, err := s3client.DeleteBucketReplication(&s3.DeleteBucketReplicationInput{Bucket: aws.String(srcBucket)})
+			return err
+		}
+		_, err := s3client.PutBucketReplication(&s3.PutBucketReplicationInput{
+			Bucket:                   aws.String(srcBucket),
+			ReplicationConfiguration: existing,
+		})
+		return err
+	})
 	return nil
 }
 
-// enableBucketVersioning enables versioning on the given bucket.
-func enableBucketVersioning(s3client *s3.S3, bucketName string) error {
-	_, err := s3client.PutBucketVersioning(&s3.PutBucketVersioningInput{
-		Bucket: aws.String(bucketName),
-		VersioningConfiguration: &s3.VersioningConfiguration{
-			Status: aws.String("Enabled"),
-		},
+// getReplicationConfiguration returns the bucket's replication configuration, or nil if it has none.
+func getReplicationConfiguration(s3client *s3.S3, bucket string) (*s3.ReplicationConfiguration, error) {
+	out, err := s3client.GetBucketReplication(&s3.GetBucketReplicationInput{
+		Bucket: aws.String(bucket),
 	})
-	return err
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ReplicationConfigurationNotFoundError" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("GetBucketReplication failed: %w", err)
+	}
+	return out.ReplicationConfiguration, nil
 }
 
-// ensureReplicationRole creates (or returns existing) an IAM role for S3 replication and attaches an inline policy.
-// The role's trust policy allows the S3 service to assume it.
-func ensureReplicationRole(iamSvc *iam.IAM, roleName, srcBucket, dstBucket, dstRegion string) (string, error) {
-	assumeRolePolicy := map[string]interface{}{
-		"Version": "2012-10-17",
-		"Statement": []map[string]interface{}{
-			{
-				"Effect": "Allow",
-				"Principal": map[string]interface{}{
-					"Service": "s3.amazonaws.com",
-				},
-				"Action": "sts:AssumeRole",
-			},
-		},
+// errLegacyRules reports legacy V1 replication rules that may not be converted (--refuse-legacy-rules).
+var errLegacyRules = errors.New("has legacy V1 replication rules")
+
+// convertLegacyRules rewrites legacy V1 rules, which have a top-level Prefix and no Filter or Priority, as
+// equivalent V2 rules: the prefix moves into the filter, each rule gets the next free priority and delete
+// markers stay replicated, as V1 rules always replicate them. V2 rules are returned unchanged. The second
+// result describes each conversion. With refuse, legacy rules are not converted: the rules are returned as they
+// are, together with the conversions that would be needed and errLegacyRules.
+func convertLegacyRules(existingRules []*s3.ReplicationRule, refuse bool) ([]*s3.ReplicationRule, []string, error) {
+	maxPriority := int64(0)
+	for _, r := range existingRules {
+		if r.Priority != nil && *r.Priority > maxPriority {
+			maxPriority = *r.Priority
+		}
+	}
+	var converted []string
+	rules := make([]*s3.ReplicationRule, 0, len(existingRules))
+	for _, r := range existingRules {
+		if r.Filter != nil {
+			rules = append(rules, r)
+			continue
+		}
+		v2 := *r
+		maxPriority++
+		v2.Filter = &s3.ReplicationRuleFilter{Prefix: aws.String(aws.StringValue(r.Prefix))}
+		v2.Prefix = nil
+		v2.Priority = aws.Int64(maxPriority)
+		v2.DeleteMarkerReplication = &s3.DeleteMarkerReplication{Status: aws.String("Enabled")}
+		rules = append(rules, &v2)
+		converted = append(converted, fmt.Sprintf("rule %s: Prefix %q -> Filter.Prefix %q, Priority %d, DeleteMarkerReplication Enabled",
+			valueOrNone(aws.StringValue(r.ID)), aws.StringValue(r.Prefix), aws.StringValue(r.Prefix), maxPriority))
+	}
+	if refuse && len(converted) > 0 {
+		return existingRules, converted, errLegacyRules
 	}
-	assumePolicyBytes, _ := json.Marshal(assumeRolePolicy)
+	return rules, converted, nil
+}
 
-	createRoleOutput, err := iamSvc.CreateRole(&iam.CreateRoleInput{
-		RoleName:                 aws.String(roleName),
-		AssumeRolePolicyDocument: aws.String(string(assumePolicyBytes)),
-		Description:              aws.String("Role for S3 cross-region replication"),
-	})
-	var roleArn string
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			// If role already exists, retrieve it
-			if aerr.Code() == iam.ErrCodeEntityAlreadyExistsException {
-				// Get role
-				out, gerr := iamSvc.GetRole(&iam.GetRoleInput{RoleName: aws.String(roleName)})
-				if gerr != nil {
-					return "", fmt.Errorf("role exists but failed to get role: %w", gerr)
+// buildReplicationRules merges the rules for dests (one per filter) into the existing rules.
+// A rule with the same ID is updated in place with mergeReplicationRule and keeps its priority; new rules get
+// the next free priority unless the filter sets one explicitly. An existing rule created by other means for the same destination
+// bucket is taken over by the destination's first rule, as earlier versions of this tool did.
+// An explicit priority that another rule kept on the bucket already holds is an error, as AWS would reject it.
+func buildReplicationRules(existingRules []*s3.ReplicationRule, src SourceSpec, prune bool) ([]*s3.ReplicationRule, error) {
+	dests := src.Destinations
+	type desiredRule struct {
+		dest   DestinationSpec
+		filter FilterSpec
+		index  int
+	}
+	var order []string
+	wanted := make(map[string]desiredRule)
+	destByARN := make(map[string]DestinationSpec, len(dests))
+	for _, d := range dests {
+		destByARN[bucketArn(partitionFor(src.Region), d.Bucket)] = d
+		for i, f := range d.filters() {
+			id := ruleIDFor(d.Bucket, i)
+			order = append(order, id)
+			wanted[id] = desiredRule{d, f, i}
+		}
+	}
+
+	// Priorities set explicitly or held by existing rules are reserved; rules without one get the next free value
+	maxPriority := int64(0)
+	reserved := make(map[int64]bool)
+	existingIDs := make(map[string]bool, len(existingRules))
+	for _, r := range existingRules {
+		if r.Priority != nil {
+			reserved[*r.Priority] = true
+			if *r.Priority > maxPriority {
+				maxPriority = *r.Priority
+			}
+		}
+		existingIDs[aws.StringValue(r.ID)] = true
+	}
+	explicit := make(map[int64]string)
+	for id, w := range wanted {
+		if w.filter.Priority > 0 {
+			reserved[w.filter.Priority] = true
+			explicit[w.filter.Priority] = id
+		}
+	}
+	nextPriority := func() int64 {
+		for {
+			maxPriority++
+			if !reserved[maxPriority] {
+				reserved[maxPriority] = true
+				return maxPriority
+			}
+		}
+	}
+
+	var rules []*s3.ReplicationRule
+	done := make(map[string]bool, len(wanted))
+	for _, r := range existingRules {
+		id := aws.StringValue(r.ID)
+		if !strings.HasPrefix(id, managedRulePrefix) && r.Destination != nil {
+			// Take over a rule for a configured destination if we do not have our own yet
+			if d, ok := destByARN[aws.StringValue(r.Destination.Bucket)]; ok {
+				if firstID := ruleIDFor(d.Bucket, 0); !existingIDs[firstID] && !done[firstID] {
+					id = firstID
 				}
-				roleArn = aws.StringValue(out.Role.Arn)
-			} else {
-				return "", fmt.Errorf("CreateRole error: %w", err)
 			}
-		} else {
-			return "", fmt.Errorf("CreateRole error: %w", err)
 		}
-	} else {
-		roleArn = aws.StringValue(createRoleOutput.Role.Arn)
+		w, ok := wanted[id]
+		if !ok {
+			if prune && strings.HasPrefix(id, managedRulePrefix) {
+				// Destination or filter no longer configured
+				continue
+			}
+			rules = append(rules, r)
+			continue
+		}
+		if done[id] {
+			// Duplicate rule with the same ID; the first one wins
+			continue
+		}
+		// Update existing rule, keep its priority unless another rule is configured with it
+		priority := aws.Int64Value(r.Priority)
+		if owner := explicit[priority]; w.filter.Priority == 0 && (priority == 0 || (owner != "" && owner != id)) {
+			priority = nextPriority()
+		}
+		desired := newReplicationRule(src, w.dest, w.filter, w.index, priority)
+		rules = append(rules, mergeReplicationRule(r, desired, w.filter.Prefix == "" && len(w.filter.Tags) == 0))
+		done[id] = true
+	}
+	for _, id := range order {
+		if done[id] {
+			continue
+		}
+		// Add new rule with unique priority
+		w := wanted[id]
+		priority := w.filter.Priority
+		if priority == 0 {
+			priority = nextPriority()
+		}
+		rules = append(rules, newReplicationRule(src, w.dest, w.filter, w.index, priority))
+		done[id] = true
 	}
 
-	// Attach inline policy that allows S3 to replicate from source to destination.
-	// Policy gives S3 permissions to read the source object versions and write to destination bucket.
-	// NOTE: Adjust policy if you use KMS or need additional permissions.
-	policy := map[string]interface{}{
-		"Version": "2012-10-17",
-		"Statement": []map[string]interface{}{
-			{
-				"Effect": "Allow",
-				"Action": []string{
-					"s3:GetObjectVersion",
-					"s3:GetObjectVersionAcl",
-					"s3:GetObjectVersionTagging",
-					"s3:GetObjectVersionForReplication",
-					"s3:ListBucket",
-					"s3:GetReplicationConfiguration",
-				},
-				"Resource": []string{
-					fmt.Sprintf("arn:aws:s3:::%s", srcBucket),
-					fmt.Sprintf("arn:aws:s3:::%s/*", srcBucket),
-				},
-			},
-			{
-				"Effect": "Allow",
-				"Action": []string{
-					"s3:ReplicateObject",
-					"s3:ReplicateDelete",
-					"s3:ReplicateTags",
-					"s3:PutObjectAcl",
-					"s3:PutObjectVersionAcl",
-					"s3:PutObjectVersionTagging",
-					"s3:PutObject",
-				},
-				"Resource": []string{
-					fmt.Sprintf("arn:aws:s3:::%s", dstBucket),
-					fmt.Sprintf("arn:aws:s3:::%s/*", dstBucket),
-				},
-			},
-		},
+	holder := make(map[int64]string, len(rules))
+	for _, r := range rules {
+		id, priority := aws.StringValue(r.ID), aws.Int64Value(r.Priority)
+		if other, ok := holder[priority]; ok {
+			return nil, fmt.Errorf("rules %s and %s on %s both have priority %d; configure another priority or change the existing rule",
+				other, id, src.Bucket, priority)
+		}
+		holder[priority] = id
 	}
+	return rules, nil
+}
 
-	policyBytes, _ := json.Marshal(policy)
-	// Create a unique policy name for each src/dest bucket pair
-	policyName := fmt.Sprintf("%s-replication-%s-to-%s", roleName, srcBucket, dstBucket)
-	_, err = iamSvc.PutRolePolicy(&iam.PutRolePolicyInput{
-		RoleName:       aws.String(roleName),
-		PolicyName:     aws.String(policyName),
-		PolicyDocument: aws.String(string(policyBytes)),
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to put role policy: %w", err)
+// mergeReplicationRule updates a copy of an existing rule with the settings of desired, so that settings
+// the tool does not model survive. Everything the tool manages is owned and taken from desired, even when
+// desired leaves it unset: ID, status, priority, destination bucket, replica storage class, Replication Time
+// Control, metrics, cross-account ownership, KMS settings, delete marker and existing object replication and
+// replica modification sync. Removing a setting from the configuration therefore turns it off on the rule.
+// With keepFilter (the destination configures no filter) an existing filter is kept.
+func mergeReplicationRule(existing, desired *s3.ReplicationRule, keepFilter bool) *s3.ReplicationRule {
+	merged := *existing
+	merged.ID = desired.ID
+	merged.Status = desired.Status
+	merged.Priority = desired.Priority
+
+	if !keepFilter || existing.Filter == nil {
+		merged.Filter = desired.Filter
 	}
 
-	// Wait a bit for IAM propagation (IAM can be eventually consistent). Small sleep helps avoid immediate use errors.
-	time.Sleep(5 * time.Second)
+	dst := s3.Destination{}
+	if existing.Destination != nil {
+		dst = *existing.Destination
+	}
+	want := desired.Destination
+	dst.Bucket = want.Bucket
+	dst.StorageClass = want.StorageClass
+	dst.ReplicationTime = want.ReplicationTime
+	dst.Metrics = want.Metrics
+	dst.Account = want.Account
+	dst.AccessControlTranslation = want.AccessControlTranslation
+	dst.EncryptionConfiguration = want.EncryptionConfiguration
+	merged.Destination = &dst
 
-	return roleArn, nil
+	merged.DeleteMarkerReplication = desired.DeleteMarkerReplication
+	merged.ExistingObjectReplication = desired.ExistingObjectReplication
+	merged.SourceSelectionCriteria = desired.SourceSelectionCriteria
+	return &merged
 }
 
-// putReplicationConfiguration configures a replication rule on the source bucket to the destination bucket.
-func putReplicationConfiguration(s3client *s3.S3, srcBucket, dstBucket, roleArn string) error {
-	// Build the replication config:
-	// A single rule that replicates everything (empty prefix) and is enabled.
-	dstARN := fmt.Sprintf("arn:aws:s3:::%s", dstBucket)
+// newReplicationRule builds the index-th rule for a destination, replicating the objects selected by filter
+// (everything by default). An explicit priority on the filter overrides the one passed in.
+// The replica storage class, delete marker and existing object replication, Replication Time Control and
+// metrics are set as configured on the destination.
+// For a destination in another account, replicas are owned by that account.
+// With KMS keys configured, SSE-KMS objects are replicated too and their replicas encrypted with the destination key.
+func newReplicationRule(src SourceSpec, dest DestinationSpec, filter FilterSpec, index int, priority int64) *s3.ReplicationRule {
+	if filter.Priority > 0 {
+		priority = filter.Priority
+	}
+	rule := &s3.ReplicationRule{
+		ID:       aws.String(ruleIDFor(dest.Bucket, index)),
+		Status:   aws.String("Enabled"),
+		Priority: aws.Int64(priority),
+		Filter:   newReplicationRuleFilter(filter),
+		Destination: &s3.Destination{
+			Bucket: aws.String(bucketArn(partitionFor(src.Region), dest.Bucket)),
+		},
+		DeleteMarkerReplication: &s3.DeleteMarkerReplication{
+			Status: aws.String(enabledOrDisabled(dest.DeleteMarkerReplication)),
+		},
+	}
+	if dest.StorageClass != "" {
+		rule.Destination.StorageClass = aws.String(dest.StorageClass)
+	}
+	if dest.ExistingObjectReplication {
+		rule.ExistingObjectReplication = &s3.ExistingObjectReplication{Status: aws.String("Enabled")}
+	}
+	if dest.ReplicationTimeControl {
+		rule.Destination.ReplicationTime = &s3.ReplicationTime{
+			Status: aws.String("Enabled"),
+			Time:   &s3.ReplicationTimeValue{Minutes: aws.Int64(replicationTimeMinutes)},
+		}
+	}
+	if dest.Metrics {
+		rule.Destination.Metrics = &s3.Metrics{
+			Status:         aws.String("Enabled"),
+			EventThreshold: &s3.ReplicationTimeValue{Minutes: aws.Int64(replicationTimeMinutes)},
+		}
+	}
+	if dest.Account != "" {
+		rule.Destination.Account = aws.String(dest.Account)
+		rule.Destination.AccessControlTranslation = &s3.AccessControlTranslation{Owner: aws.String("Destination")}
+	}
+	if dest.ReplicaModifications {
+		rule.SourceSelectionCriteria = &s3.SourceSelectionCriteria{
+			ReplicaModifications: &s3.ReplicaModifications{Status: aws.String("Enabled")},
+		}
+	}
+	if src.KMSKeyArn != "" && dest.KMSKeyArn != "" {
+		if rule.SourceSelectionCriteria == nil {
+			rule.SourceSelectionCriteria = &s3.SourceSelectionCriteria{}
+		}
+		rule.SourceSelectionCriteria.SseKmsEncryptedObjects = &s3.SseKmsEncryptedObjects{Status: aws.String("Enabled")}
+		rule.Destination.EncryptionConfiguration = &s3.EncryptionConfiguration{
+			ReplicaKmsKeyID: aws.String(dest.KMSKeyArn),
+		}
+	}
+	return rule
+}
 
-	// Prepare destination
-	destination := &s3.Destination{
-		Bucket: aws.String(dstARN),
-		// StorageClass: aws.String("STANDARD"), // optional; can set to reduced_redundancy etc.
+// enabledOrDisabled renders a flag as the Status value S3 expects.
+func enabledOrDisabled(enabled bool) string {
+	if enabled {
+		return "Enabled"
 	}
+	return "Disabled"
+}
 
-	// Get existing replication configuration
-	var existingRules []*s3.ReplicationRule
-	getOut, err := s3client.GetBucketReplication(&s3.GetBucketReplicationInput{
-		Bucket: aws.String(srcBucket),
-	})
-	if err == nil && getOut.ReplicationConfiguration != nil {
-		existingRules = getOut.ReplicationConfiguration.Rules
+// newReplicationRuleFilter picks the filter shape AWS expects: a bare Prefix or Tag for a single condition,
+// And when a prefix is combined with tags or several tags are given.
+func newReplicationRuleFilter(filter FilterSpec) *s3.ReplicationRuleFilter {
+	keys := make([]string, 0, len(filter.Tags))
+	for k := range filter.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var tags []*s3.Tag
+	for _, k := range keys {
+		tags = append(tags, &s3.Tag{Key: aws.String(k), Value: aws.String(filter.Tags[k])})
 	}
 
-	// Check if a rule for this destination bucket already exists
-	ruleID := fmt.Sprintf("replicate-to-%s", dstBucket)
-	updated := false
-	maxPriority := int64(0)
-	for _, r := range existingRules {
-		if r.Priority != nil && *r.Priority > maxPriority {
-			maxPriority = *r.Priority
+	switch {
+	case len(tags) == 0:
+		return &s3.ReplicationRuleFilter{Prefix: aws.String(filter.Prefix)}
+	case len(tags) == 1 && filter.Prefix == "":
+		return &s3.ReplicationRuleFilter{Tag: tags[0]}
+	default:
+		and := &s3.ReplicationRuleAndOperator{Tags: tags}
+		if filter.Prefix != "" {
+			and.Prefix = aws.String(filter.Prefix)
 		}
+		return &s3.ReplicationRuleFilter{And: and}
 	}
-	for i, r := range existingRules {
-		if r.Destination != nil && r.Destination.Bucket != nil && destination.Bucket != nil && *r.Destination.Bucket == *destination.Bucket {
-			// Update existing rule, keep its priority
-			priority := r.Priority
-			if priority == nil {
-				priority = aws.Int64(maxPriority + 1)
-			}
-			existingRules[i] = &s3.ReplicationRule{
-				ID:       aws.String(ruleID),
-				Status:   aws.String("Enabled"),
-				Priority: priority,
-				Filter: &s3.ReplicationRuleFilter{
-					Prefix: aws.String(""),
-				},
-				Destination: destination,
-				DeleteMarkerReplication: &s3.DeleteMarkerReplication{
-					Status: aws.String("Disabled"),
-				},
+}
+
+// diffReplicationConfiguration lists the differences between two replication configurations, rule by rule.
+// A nil before means the bucket has no configuration yet.
+func diffReplicationConfiguration(before, after *s3.ReplicationConfiguration) []string {
+	if before == nil {
+		before = &s3.ReplicationConfiguration{}
+	}
+	var changes []string
+	if aws.StringValue(before.Role) != aws.StringValue(after.Role) {
+		changes = append(changes, fmt.Sprintf("Role: %s -> %s", valueOrNone(aws.StringValue(before.Role)), aws.StringValue(after.Role)))
+	}
+	oldRules := make(map[string]*s3.ReplicationRule, len(before.Rules))
+	for _, r := range before.Rules {
+		oldRules[aws.StringValue(r.ID)] = r
+	}
+	newIDs := make(map[string]bool, len(after.Rules))
+	for _, r := range after.Rules {
+		id := aws.StringValue(r.ID)
+		newIDs[id] = true
+		old, ok := oldRules[id]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("+ rule %s -> %s (priority %d)",
+				id, aws.StringValue(r.Destination.Bucket), aws.Int64Value(r.Priority)))
+			continue
+		}
+		if fields := diffFields(old, r); len(fields) > 0 {
+			changes = append(changes, "~ rule "+id)
+			for _, f := range fields {
+				changes = append(changes, "    "+f)
 			}
-			updated = true
-			break
 		}
 	}
-	if !updated {
-		// Add new rule for this destination bucket with unique priority
-		newRule := &s3.ReplicationRule{
-			ID:       aws.String(ruleID),
-			Status:   aws.String("Enabled"),
-			Priority: aws.Int64(maxPriority + 1),
-			Filter: &s3.ReplicationRuleFilter{
-				Prefix: aws.String(""),
-			},
-			Destination: destination,
-			DeleteMarkerReplication: &s3.DeleteMarkerReplication{
-				Status: aws.String("Disabled"),
-			},
+	for _, r := range before.Rules {
+		if !newIDs[aws.StringValue(r.ID)] {
+			changes = append(changes, "- rule "+aws.StringValue(r.ID))
 		}
-		existingRules = append(existingRules, newRule)
 	}
+	return changes
+}
 
-	configuration := &s3.ReplicationConfiguration{
-		Role:  aws.String(roleArn),
-		Rules: existingRules,
+// diffFields compares two JSON-serialisable values leaf by leaf and returns "path: old -> new" lines sorted by path.
+func diffFields(before, after interface{}) []string {
+	oldLeaves, newLeaves := flatten(before), flatten(after)
+	paths := make(map[string]bool)
+	for p := range oldLeaves {
+		paths[p] = true
+	}
+	for p := range newLeaves {
+		paths[p] = true
+	}
+	var changes []string
+	for p := range paths {
+		o, oldOK := oldLeaves[p]
+		n, newOK := newLeaves[p]
+		if oldOK && newOK && o == n {
+			continue
+		}
+		if !oldOK {
+			o = "(none)"
+		}
+		if !newOK {
+			n = "(none)"
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", p, o, n))
 	}
+	sort.Strings(changes)
+	return changes
+}
 
-	_, err = s3client.PutBucketReplication(&s3.PutBucketReplicationInput{
-		Bucket:                   aws.String(srcBucket),
-		ReplicationConfiguration: configuration,
-	})
+// flatten maps each leaf of v to its JSON value, keyed by a path such as Destination.Bucket or Statement[0].Action[1].
+func flatten(v interface{}) map[string]string {
+	leaves := make(map[string]string)
+	data, err := json.Marshal(v)
 	if err != nil {
-		return fmt.Errorf("PutBucketReplication failed: %w", err)
+		return leaves
 	}
-	return nil
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return leaves
+	}
+	var walk func(path string, v interface{})
+	walk = func(path string, v interface{}) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, child := range t {
+				if path != "" {
+					k = path + "." + k
+				}
+				walk(k, child)
+			}
+		case []interface{}:
+			for i, child := range t {
+				walk(fmt.Sprintf("%s[%d]", path, i), child)
+			}
+		case nil:
+			// Unset fields are treated as absent
+		default:
+			b, _ := json.Marshal(t)
+			leaves[path] = string(b)
+		}
+	}
+	walk("", generic)
+	return leaves
+}
+
+// valueOrNone renders an empty value as "(none)" in diffs.
+func valueOrNone(v string) string {
+	if v == "" {
+		return "(none)"
+	}
+	return v
 }
@@ -0,0 +1,897 @@
+package main
+
+// Run with: go test s3_crr_setup.go s3_crr_setup_test.go
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestBuildReplicationRules(t *testing.T) {
+	existingRule := func(id, bucket string, priority int64) *s3.ReplicationRule {
+		return &s3.ReplicationRule{
+			ID:          aws.String(id),
+			Status:      aws.String("Enabled"),
+			Priority:    aws.Int64(priority),
+			Destination: &s3.Destination{Bucket: aws.String("arn:aws:s3:::" + bucket)},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		existing []*s3.ReplicationRule
+		dests    []DestinationSpec
+		prune    bool
+		want     map[string]int64 // rule ID -> priority
+		wantErr  bool
+	}{
+		{
+			name:  "new rules are numbered in order",
+			dests: []DestinationSpec{{Bucket: "a", Region: "us-west-2"}, {Bucket: "b", Region: "eu-west-1"}},
+			want:  map[string]int64{"replicate-to-a": 1, "replicate-to-b": 2},
+		},
+		{
+			name:  "explicit priority is not handed out again",
+			dests: []DestinationSpec{{Bucket: "a", Region: "us-west-2", Priority: 2}, {Bucket: "b", Region: "eu-west-1"}},
+			want:  map[string]int64{"replicate-to-a": 2, "replicate-to-b": 1},
+		},
+		{
+			name:     "explicit priority above existing ones is skipped",
+			existing: []*s3.ReplicationRule{existingRule("manual", "other", 1)},
+			dests:    []DestinationSpec{{Bucket: "a", Region: "us-west-2", Priority: 2}, {Bucket: "b", Region: "eu-west-1"}},
+			want:     map[string]int64{"manual": 1, "replicate-to-a": 2, "replicate-to-b": 3},
+		},
+		{
+			name:     "existing managed rule keeps its priority",
+			existing: []*s3.ReplicationRule{existingRule("replicate-to-a", "a", 5)},
+			dests:    []DestinationSpec{{Bucket: "a", Region: "us-west-2"}, {Bucket: "b", Region: "eu-west-1"}},
+			want:     map[string]int64{"replicate-to-a": 5, "replicate-to-b": 6},
+		},
+		{
+			name:     "explicit priority overrides an existing rule's",
+			existing: []*s3.ReplicationRule{existingRule("replicate-to-a", "a", 5)},
+			dests:    []DestinationSpec{{Bucket: "a", Region: "us-west-2", Priority: 3}},
+			want:     map[string]int64{"replicate-to-a": 3},
+		},
+		{
+			name:     "unmanaged rule for a configured destination is taken over",
+			existing: []*s3.ReplicationRule{existingRule("manual", "a", 4)},
+			dests:    []DestinationSpec{{Bucket: "a", Region: "us-west-2"}},
+			want:     map[string]int64{"replicate-to-a": 4},
+		},
+		{
+			name: "prune drops managed rules no longer configured",
+			existing: []*s3.ReplicationRule{
+				existingRule("replicate-to-gone", "gone", 1),
+				existingRule("manual", "other", 2),
+			},
+			dests: []DestinationSpec{{Bucket: "a", Region: "us-west-2"}},
+			prune: true,
+			want:  map[string]int64{"manual": 2, "replicate-to-a": 3},
+		},
+		{
+			name:     "existing managed rule gives way to an explicit priority",
+			existing: []*s3.ReplicationRule{existingRule("replicate-to-a", "a", 2)},
+			dests:    []DestinationSpec{{Bucket: "a", Region: "us-west-2"}, {Bucket: "b", Region: "eu-west-1", Priority: 2}},
+			want:     map[string]int64{"replicate-to-a": 3, "replicate-to-b": 2},
+		},
+		{
+			name:     "explicit priority held by an unmanaged rule",
+			existing: []*s3.ReplicationRule{existingRule("manual", "other", 2)},
+			dests:    []DestinationSpec{{Bucket: "a", Region: "us-west-2", Priority: 2}},
+			wantErr:  true,
+		},
+		{
+			name:     "without prune managed rules are kept",
+			existing: []*s3.ReplicationRule{existingRule("replicate-to-gone", "gone", 1)},
+			dests:    []DestinationSpec{{Bucket: "a", Region: "us-west-2"}},
+			want:     map[string]int64{"replicate-to-gone": 1, "replicate-to-a": 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := SourceSpec{Bucket: "src", Region: "us-east-1", Role: "role", Destinations: tt.dests}
+			rules, err := buildReplicationRules(tt.existing, src, tt.prune)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d rules", len(rules))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := make(map[string]int64, len(rules))
+			seen := make(map[int64]string, len(rules))
+			for _, r := range rules {
+				id, priority := aws.StringValue(r.ID), aws.Int64Value(r.Priority)
+				if other, ok := seen[priority]; ok {
+					t.Errorf("rules %s and %s share priority %d", other, id, priority)
+				}
+				seen[priority] = id
+				got[id] = priority
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("got rules %v, want %v", got, tt.want)
+			}
+			for id, priority := range tt.want {
+				if p, ok := got[id]; !ok || p != priority {
+					t.Errorf("rule %s: got priority %d (present: %v), want %d", id, p, ok, priority)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeByID(t *testing.T) {
+	type entry struct{ ID, Value string }
+	id := func(e entry) string { return e.ID }
+
+	tests := []struct {
+		name             string
+		current, desired []entry
+		want             []entry
+	}{
+		{
+			name:    "destination-only entries are kept",
+			current: []entry{{"dst", "1"}},
+			desired: []entry{{"src", "2"}},
+			want:    []entry{{"dst", "1"}, {"src", "2"}},
+		},
+		{
+			name:    "same ID is replaced in place",
+			current: []entry{{"a", "old"}, {"b", "1"}},
+			desired: []entry{{"a", "new"}},
+			want:    []entry{{"a", "new"}, {"b", "1"}},
+		},
+		{
+			name:    "entries without ID are matched by content",
+			current: []entry{{"", "same"}, {"", "dst"}},
+			desired: []entry{{"", "same"}, {"", "src"}},
+			want:    []entry{{"", "same"}, {"", "dst"}, {"", "src"}},
+		},
+		{
+			name:    "duplicate IDs in desired are written once",
+			desired: []entry{{"a", "1"}, {"a", "2"}},
+			want:    []entry{{"a", "2"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeByID(tt.current, tt.desired, id)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestDestFlagSet(t *testing.T) {
+	const key = "arn:aws:kms:eu-west-1:111122223333:key/2222bbbb"
+	tests := []struct {
+		value   string
+		want    DestinationSpec
+		wantErr bool
+	}{
+		{value: "dst:us-west-2", want: DestinationSpec{Bucket: "dst", Region: "us-west-2"}},
+		{value: "dst:us-west-2:GLACIER_IR", want: DestinationSpec{Bucket: "dst", Region: "us-west-2", StorageClass: "GLACIER_IR"}},
+		{value: "dst:eu-west-1:" + key, want: DestinationSpec{Bucket: "dst", Region: "eu-west-1", KMSKeyArn: key}},
+		{value: "dst:eu-west-1:STANDARD_IA:" + key, want: DestinationSpec{Bucket: "dst", Region: "eu-west-1", StorageClass: "STANDARD_IA", KMSKeyArn: key}},
+		{value: "dst", wantErr: true},
+		{value: ":us-west-2", wantErr: true},
+		{value: "dst:us-west-2:STANDARD_IA:not-an-arn", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var d destFlag
+			err := d.Set(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := d[0]
+			if got.Bucket != tt.want.Bucket || got.Region != tt.want.Region || got.StorageClass != tt.want.StorageClass || got.KMSKeyArn != tt.want.KMSKeyArn {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeReplicationRule(t *testing.T) {
+	const key = "arn:aws:kms:us-west-2:111122223333:key/1111aaaa"
+	src := SourceSpec{Bucket: "src", Region: "us-east-1", Role: "role", KMSKeyArn: "arn:aws:kms:us-east-1:111122223333:key/0000ffff"}
+	rule := func(d DestinationSpec, f FilterSpec) *s3.ReplicationRule {
+		return newReplicationRule(src, d, f, 0, 1)
+	}
+	plain := DestinationSpec{Bucket: "dst", Region: "us-west-2"}
+	full := DestinationSpec{
+		Bucket:                    "dst",
+		Region:                    "us-west-2",
+		StorageClass:              "GLACIER_IR",
+		Account:                   "444455556666",
+		KMSKeyArn:                 key,
+		ReplicationTimeControl:    true,
+		Metrics:                   true,
+		ExistingObjectReplication: true,
+		DeleteMarkerReplication:   true,
+		ReplicaModifications:      true,
+	}
+	manual := rule(plain, FilterSpec{})
+	manual.Filter = &s3.ReplicationRuleFilter{Prefix: aws.String("by-hand/")}
+
+	tests := []struct {
+		name       string
+		existing   *s3.ReplicationRule
+		desired    *s3.ReplicationRule
+		keepFilter bool
+		want       *s3.ReplicationRule
+	}{
+		{
+			name:     "settings are added",
+			existing: rule(plain, FilterSpec{}),
+			desired:  rule(full, FilterSpec{}),
+			want:     rule(full, FilterSpec{}),
+		},
+		{
+			name:     "removed settings are turned off",
+			existing: rule(full, FilterSpec{}),
+			desired:  rule(plain, FilterSpec{}),
+			want:     rule(plain, FilterSpec{}),
+		},
+		{
+			name:     "removing the KMS key clears the KMS settings",
+			existing: rule(DestinationSpec{Bucket: "dst", Region: "us-west-2", KMSKeyArn: key, ReplicaModifications: true}, FilterSpec{}),
+			desired:  rule(DestinationSpec{Bucket: "dst", Region: "us-west-2", ReplicaModifications: true}, FilterSpec{}),
+			want:     rule(DestinationSpec{Bucket: "dst", Region: "us-west-2", ReplicaModifications: true}, FilterSpec{}),
+		},
+		{
+			name:     "removing the account clears ownership translation",
+			existing: rule(DestinationSpec{Bucket: "dst", Region: "us-west-2", Account: "444455556666"}, FilterSpec{}),
+			desired:  rule(plain, FilterSpec{}),
+			want:     rule(plain, FilterSpec{}),
+		},
+		{
+			name:       "filter set by hand is kept without a configured filter",
+			existing:   manual,
+			desired:    rule(full, FilterSpec{}),
+			keepFilter: true,
+			want: func() *s3.ReplicationRule {
+				r := rule(full, FilterSpec{})
+				r.Filter = manual.Filter
+				return r
+			}(),
+		},
+		{
+			name:     "configured filter replaces one set by hand",
+			existing: manual,
+			desired:  rule(plain, FilterSpec{Prefix: "logs/"}),
+			want:     rule(plain, FilterSpec{Prefix: "logs/"}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeReplicationRule(tt.existing, tt.desired, tt.keepFilter)
+			if changes := diffFields(tt.want, got); len(changes) > 0 {
+				t.Errorf("merged rule differs from the wanted one:\n%s", strings.Join(changes, "\n"))
+			}
+		})
+	}
+}
+
+func TestReplicationBucketPolicySids(t *testing.T) {
+	const role = "arn:aws:iam::111122223333:role/replication"
+	dst := DestinationSpec{Bucket: "shared", Region: "us-west-2", Account: "444455556666"}
+	sids := func(policy map[string]interface{}) map[string]bool {
+		out := make(map[string]bool)
+		statements, _ := policy["Statement"].([]interface{})
+		for _, st := range statements {
+			m, _ := st.(map[string]interface{})
+			sid, _ := m["Sid"].(string)
+			out[sid] = true
+		}
+		return out
+	}
+
+	if sidFor("my-logs") == sidFor("mylogs") {
+		t.Fatalf("my-logs and mylogs share the Sid fragment %s", sidFor("mylogs"))
+	}
+
+	other := map[string]interface{}{"Sid": "DenyInsecure", "Effect": "Deny"}
+	legacy := map[string]interface{}{"Sid": "CrrReplicationFromlogsObjects", "Effect": "Allow"}
+	policy := map[string]interface{}{"Version": "2012-10-17", "Statement": []interface{}{other, legacy}}
+	for _, src := range []string{"logs-archive", "my-logs", "mylogs", "logs"} {
+		policy = mergeReplicationBucketPolicy(policy, src, dst, role)
+	}
+	got := sids(policy)
+	if got["CrrReplicationFromlogsObjects"] {
+		t.Errorf("statement without hash from an earlier version was not replaced")
+	}
+	for _, src := range []string{"logs-archive", "my-logs", "mylogs", "logs"} {
+		for _, sid := range replicationSids(src)[:2] {
+			if !got[sid] {
+				t.Errorf("statement %s for %s missing after merging the other sources", sid, src)
+			}
+		}
+	}
+	if want := 1 + 4*2; len(got) != want {
+		t.Errorf("got %d statements %v, want %d", len(got), got, want)
+	}
+
+	removed := sids(removeBucketPolicyStatements(policy, replicationSids("logs")))
+	for _, src := range []string{"logs-archive", "my-logs", "mylogs"} {
+		for _, sid := range replicationSids(src)[:2] {
+			if !removed[sid] {
+				t.Errorf("removing the statements of logs also removed %s", sid)
+			}
+		}
+	}
+	if removed[replicationSids("logs")[0]] || !removed["DenyInsecure"] {
+		t.Errorf("got %v after removing the statements of logs", removed)
+	}
+}
+
+// statementSids lists the Sids of a policy's statements in order.
+func statementSids(policy map[string]interface{}) []string {
+	var sids []string
+	statements, _ := policy["Statement"].([]interface{})
+	for _, st := range statements {
+		m, _ := st.(map[string]interface{})
+		sid, _ := m["Sid"].(string)
+		sids = append(sids, sid)
+	}
+	return sids
+}
+
+func TestMergeRolePolicy(t *testing.T) {
+	source := func(bucket string, dests ...string) SourceSpec {
+		src := SourceSpec{Bucket: bucket, Region: "us-east-1", Role: "role"}
+		for _, d := range dests {
+			src.Destinations = append(src.Destinations, DestinationSpec{Bucket: d, Region: "us-west-2"})
+		}
+		return src
+	}
+	policyOf := func(sids ...string) map[string]interface{} {
+		var statements []interface{}
+		for _, sid := range sids {
+			statements = append(statements, map[string]interface{}{"Sid": sid, "Effect": "Allow"})
+		}
+		return map[string]interface{}{"Version": "2012-10-17", "Statement": statements}
+	}
+
+	tests := []struct {
+		name    string
+		policy  map[string]interface{}
+		sources []SourceSpec
+		prune   bool
+		want    []string
+	}{
+		{
+			name:    "sources differing only in dashes keep their own statements",
+			sources: []SourceSpec{source("my-logs", "a"), source("mylogs", "b")},
+			want: []string{
+				readSid("my-logs"), readSid("mylogs"),
+				pairSid("my-logs", "a"), pairSid("mylogs", "b"),
+			},
+		},
+		{
+			name:    "running a source again replaces its statements",
+			sources: []SourceSpec{source("logs", "a"), source("logs", "a")},
+			want:    []string{readSid("logs"), pairSid("logs", "a")},
+		},
+		{
+			name:    "other sources and statements are kept",
+			policy:  policyOf("Custom", readSid("logs-archive"), pairSid("logs-archive", "a")),
+			sources: []SourceSpec{source("logs", "a")},
+			want: []string{
+				"Custom", readSid("logs"), readSid("logs-archive"),
+				pairSid("logs", "a"), pairSid("logs-archive", "a"),
+			},
+		},
+		{
+			name:    "without prune a destination no longer listed is kept",
+			policy:  policyOf(readSid("logs"), pairSid("logs", "gone")),
+			sources: []SourceSpec{source("logs", "a")},
+			want:    []string{readSid("logs"), pairSid("logs", "a"), pairSid("logs", "gone")},
+		},
+		{
+			name:    "prune drops a destination no longer listed",
+			policy:  policyOf(readSid("logs"), pairSid("logs", "gone"), pairSid("logs-archive", "gone")),
+			sources: []SourceSpec{source("logs", "a")},
+			prune:   true,
+			want:    []string{readSid("logs"), pairSid("logs", "a"), pairSid("logs-archive", "gone")},
+		},
+		{
+			name:    "statements without hash are replaced",
+			policy:  policyOf(legacyReadSid("logs"), legacyPairSid("logs", "a"), legacyPairSid("logs", "a")+"Owner"),
+			sources: []SourceSpec{source("logs", "a")},
+			want:    []string{readSid("logs"), pairSid("logs", "a")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := tt.policy
+			for _, src := range tt.sources {
+				policy = mergeRolePolicy(policy, src, tt.prune)
+			}
+			got := statementSids(policy)
+			want := append([]string(nil), tt.want...)
+			sort.Strings(want)
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("got Sids %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRemovePairFromRolePolicy(t *testing.T) {
+	policy := map[string]interface{}{}
+	for _, src := range []SourceSpec{
+		{Bucket: "my-logs", Region: "us-east-1", Destinations: []DestinationSpec{{Bucket: "a", Region: "us-west-2"}, {Bucket: "b", Region: "us-west-2", Account: "444455556666"}}},
+		{Bucket: "mylogs", Region: "us-east-1", Destinations: []DestinationSpec{{Bucket: "a", Region: "us-west-2"}}},
+	} {
+		policy = mergeRolePolicy(policy, src, false)
+	}
+
+	tests := []struct {
+		name  string
+		pairs [][2]string
+		want  []string
+	}{
+		{
+			name:  "read statement stays while a destination is left",
+			pairs: [][2]string{{"my-logs", "b"}},
+			want:  []string{readSid("my-logs"), readSid("mylogs"), pairSid("my-logs", "a"), pairSid("mylogs", "a")},
+		},
+		{
+			name:  "read statement goes with the last destination",
+			pairs: [][2]string{{"my-logs", "a"}, {"my-logs", "b"}},
+			want:  []string{readSid("mylogs"), pairSid("mylogs", "a")},
+		},
+		{
+			name:  "similar source names are not touched",
+			pairs: [][2]string{{"mylogs", "a"}},
+			want:  []string{readSid("my-logs"), pairSid("my-logs", "a"), pairSid("my-logs", "b"), pairSid("my-logs", "b") + "Owner"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := policy
+			for _, p := range tt.pairs {
+				got = removePairFromRolePolicy(got, p[0], p[1])
+			}
+			gotSids := statementSids(got)
+			sort.Strings(gotSids)
+			want := append([]string(nil), tt.want...)
+			sort.Strings(want)
+			if strings.Join(gotSids, ",") != strings.Join(want, ",") {
+				t.Errorf("got Sids %v, want %v", gotSids, want)
+			}
+		})
+	}
+}
+
+func TestSplitPolicy(t *testing.T) {
+	statement := func(i, size int) interface{} {
+		return map[string]interface{}{
+			"Sid":      fmt.Sprintf("S%03d", i),
+			"Effect":   "Allow",
+			"Action":   "s3:GetObject",
+			"Resource": "arn:aws:s3:::" + strings.Repeat("x", size),
+		}
+	}
+	policyOf := func(n, size int) map[string]interface{} {
+		var statements []interface{}
+		for i := 0; i < n; i++ {
+			statements = append(statements, statement(i, size))
+		}
+		return map[string]interface{}{"Version": "2012-10-17", "Statement": statements}
+	}
+
+	tests := []struct {
+		name     string
+		policy   map[string]interface{}
+		wantDocs int
+		wantErr  bool
+	}{
+		{name: "small policy fits one document", policy: policyOf(3, 100), wantDocs: 1},
+		{name: "large policy is split", policy: policyOf(10, 2000), wantDocs: 5},
+		{name: "oversized statement", policy: policyOf(1, managedPolicySizeLimit), wantErr: true},
+		{name: "more documents than IAM attaches", policy: policyOf(2*maxManagedPolicies+2, 3000), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := splitPolicy(tt.policy)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d documents", len(docs))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(docs) != tt.wantDocs {
+				t.Errorf("got %d documents, want %d", len(docs), tt.wantDocs)
+			}
+			var sids []string
+			for _, doc := range docs {
+				if size := policySize(doc); size > managedPolicySizeLimit {
+					t.Errorf("document of %d characters exceeds the limit of %d", size, managedPolicySizeLimit)
+				}
+				sids = append(sids, statementSids(doc)...)
+			}
+			if want := statementSids(tt.policy); strings.Join(sids, ",") != strings.Join(want, ",") {
+				t.Errorf("statements got reordered or lost: got %v, want %v", sids, want)
+			}
+		})
+	}
+}
+
+func TestConvertLegacyRules(t *testing.T) {
+	v1 := func(id, prefix string) *s3.ReplicationRule {
+		return &s3.ReplicationRule{
+			ID:          aws.String(id),
+			Status:      aws.String("Enabled"),
+			Prefix:      aws.String(prefix),
+			Destination: &s3.Destination{Bucket: aws.String("arn:aws:s3:::dst")},
+		}
+	}
+	v2 := func(id string, priority int64) *s3.ReplicationRule {
+		return &s3.ReplicationRule{
+			ID:                      aws.String(id),
+			Status:                  aws.String("Enabled"),
+			Priority:                aws.Int64(priority),
+			Filter:                  &s3.ReplicationRuleFilter{Prefix: aws.String("")},
+			Destination:             &s3.Destination{Bucket: aws.String("arn:aws:s3:::dst")},
+			DeleteMarkerReplication: &s3.DeleteMarkerReplication{Status: aws.String("Disabled")},
+		}
+	}
+	converted := func(id, prefix string, priority int64) *s3.ReplicationRule {
+		r := v1(id, prefix)
+		r.Prefix = nil
+		r.Filter = &s3.ReplicationRuleFilter{Prefix: aws.String(prefix)}
+		r.Priority = aws.Int64(priority)
+		r.DeleteMarkerReplication = &s3.DeleteMarkerReplication{Status: aws.String("Enabled")}
+		return r
+	}
+
+	tests := []struct {
+		name          string
+		existing      []*s3.ReplicationRule
+		refuse        bool
+		want          []*s3.ReplicationRule
+		wantConverted int
+		wantErr       bool
+	}{
+		{
+			name:     "V2 rules are left alone",
+			existing: []*s3.ReplicationRule{v2("a", 1), v2("b", 4)},
+			want:     []*s3.ReplicationRule{v2("a", 1), v2("b", 4)},
+		},
+		{
+			name:          "V1 rules get priorities after the existing maximum",
+			existing:      []*s3.ReplicationRule{v1("old", "logs/"), v2("a", 3), v1("older", "")},
+			want:          []*s3.ReplicationRule{converted("old", "logs/", 4), v2("a", 3), converted("older", "", 5)},
+			wantConverted: 2,
+		},
+		{
+			name:          "only V1 rules start at priority 1",
+			existing:      []*s3.ReplicationRule{v1("old", "data/")},
+			want:          []*s3.ReplicationRule{converted("old", "data/", 1)},
+			wantConverted: 1,
+		},
+		{
+			name:          "refused conversion leaves the rules as they are",
+			existing:      []*s3.ReplicationRule{v1("old", "logs/"), v2("a", 3)},
+			refuse:        true,
+			want:          []*s3.ReplicationRule{v1("old", "logs/"), v2("a", 3)},
+			wantConverted: 1,
+			wantErr:       true,
+		},
+		{
+			name:     "refusing without V1 rules is no error",
+			existing: []*s3.ReplicationRule{v2("a", 1)},
+			refuse:   true,
+			want:     []*s3.ReplicationRule{v2("a", 1)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, conversions, err := convertLegacyRules(tt.existing, tt.refuse)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if len(conversions) != tt.wantConverted {
+				t.Errorf("got %d conversions %v, want %d", len(conversions), conversions, tt.wantConverted)
+			}
+			if changes := diffFields(tt.want, got); len(changes) > 0 {
+				t.Errorf("converted rules differ:\n%s", strings.Join(changes, "\n"))
+			}
+		})
+	}
+}
+
+func TestBidirectionalSources(t *testing.T) {
+	const (
+		srcKey = "arn:aws:kms:us-east-1:111122223333:key/0000ffff"
+		dstKey = "arn:aws:kms:eu-west-1:111122223333:key/1111aaaa"
+	)
+	src := SourceSpec{
+		Bucket: "src", Region: "us-east-1", Role: "role", KMSKeyArn: srcKey, Profile: "src-profile",
+		PermissionsBoundary: "arn:aws:iam::111122223333:policy/boundary",
+		Destinations: []DestinationSpec{{
+			Bucket: "dst", Region: "eu-west-1", Prefix: "logs/", KMSKeyArn: dstKey,
+			StorageClass: "GLACIER_IR", BucketTags: map[string]string{"team": "data"},
+		}},
+	}
+
+	tests := []struct {
+		name       string
+		account    string // destination account
+		profile    string // destination profile
+		wantBack   DestinationSpec
+		wantSource SourceSpec // reverse source, without destinations
+	}{
+		{
+			name: "same account",
+			wantBack: DestinationSpec{
+				Bucket: "src", Region: "us-east-1", Prefix: "logs/", KMSKeyArn: srcKey,
+				Profile: "src-profile", ReplicaModifications: true,
+			},
+			wantSource: SourceSpec{
+				Bucket: "dst", Region: "eu-west-1", Role: "role", KMSKeyArn: dstKey,
+				PermissionsBoundary: "arn:aws:iam::111122223333:policy/boundary",
+			},
+		},
+		{
+			name:    "destination in another account",
+			account: "444455556666",
+			profile: "dst-profile",
+			wantBack: DestinationSpec{
+				Bucket: "src", Region: "us-east-1", Prefix: "logs/", KMSKeyArn: srcKey,
+				Account: "111122223333", Profile: "src-profile", ReplicaModifications: true,
+			},
+			wantSource: SourceSpec{
+				Bucket: "dst", Region: "eu-west-1", Role: "role", KMSKeyArn: dstKey, Profile: "dst-profile",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := src
+			in.Destinations = []DestinationSpec{src.Destinations[0]}
+			in.Destinations[0].Account, in.Destinations[0].Profile = tt.account, tt.profile
+			got := bidirectionalSources(in, "111122223333")
+			if len(got) != 2 {
+				t.Fatalf("got %d sources, want 2", len(got))
+			}
+
+			forward := got[0].Destinations[0]
+			if !forward.ReplicaModifications || forward.StorageClass != "GLACIER_IR" || forward.BucketTags["team"] != "data" {
+				t.Errorf("forward destination lost its settings: %+v", forward)
+			}
+			if changes := diffFields(tt.wantBack, got[1].Destinations[0]); len(changes) > 0 {
+				t.Errorf("reverse destination differs:\n%s", strings.Join(changes, "\n"))
+			}
+			reverse := got[1]
+			reverse.Destinations = nil
+			if changes := diffFields(tt.wantSource, reverse); len(changes) > 0 {
+				t.Errorf("reverse source differs:\n%s", strings.Join(changes, "\n"))
+			}
+		})
+	}
+}
+
+func TestMeshTopology(t *testing.T) {
+	buckets := []DestinationSpec{
+		{Bucket: "a", Region: "us-east-1"},
+		{Bucket: "b", Region: "eu-west-1", StorageClass: "STANDARD_IA"},
+		{Bucket: "c", Region: "ap-southeast-2"},
+	}
+	base := DestinationSpec{DeleteMarkerReplication: true, StorageClass: "GLACIER_IR"}
+
+	tests := []struct {
+		name       string
+		buckets    []DestinationSpec
+		rolePrefix string
+		wantErr    bool
+	}{
+		{name: "every bucket replicates to every other one", buckets: buckets, rolePrefix: "mesh"},
+		{
+			name:       "KMS keys are rejected",
+			buckets:    []DestinationSpec{{Bucket: "a", Region: "us-east-1", KMSKeyArn: "arn:aws:kms:us-east-1:111122223333:key/0000ffff"}, {Bucket: "b", Region: "eu-west-1"}},
+			rolePrefix: "mesh",
+			wantErr:    true,
+		},
+		{name: "role name too long", buckets: buckets, rolePrefix: strings.Repeat("r", 63), wantErr: true},
+		{
+			name:       "buckets across partitions",
+			buckets:    []DestinationSpec{{Bucket: "a", Region: "us-east-1"}, {Bucket: "b", Region: "cn-north-1"}},
+			rolePrefix: "mesh",
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topo, err := meshTopology(tt.buckets, tt.rolePrefix, base)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", topo)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(topo.Sources) != len(tt.buckets) {
+				t.Fatalf("got %d sources, want %d", len(topo.Sources), len(tt.buckets))
+			}
+			for i, src := range topo.Sources {
+				if src.Bucket != tt.buckets[i].Bucket || src.Region != tt.buckets[i].Region || src.Role != tt.rolePrefix+"-"+src.Bucket {
+					t.Errorf("source %d: got %s (%s) with role %s", i, src.Bucket, src.Region, src.Role)
+				}
+				if len(src.Destinations) != len(tt.buckets)-1 {
+					t.Errorf("source %s: got %d destinations, want %d", src.Bucket, len(src.Destinations), len(tt.buckets)-1)
+				}
+				for _, d := range src.Destinations {
+					if d.Bucket == src.Bucket {
+						t.Errorf("source %s replicates to itself", src.Bucket)
+					}
+					var want DestinationSpec
+					for _, b := range tt.buckets {
+						if b.Bucket == d.Bucket {
+							want = b
+						}
+					}
+					// The storage class of the destination bucket wins over base's, even when empty
+					if d.Region != want.Region || d.StorageClass != want.StorageClass || !d.ReplicaModifications || !d.DeleteMarkerReplication {
+						t.Errorf("source %s: destination %+v does not match bucket %+v with the base options", src.Bucket, d, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteBucketArns(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface{}
+		want interface{}
+	}{
+		{name: "bucket ARN", in: "arn:aws:s3:::src", want: "arn:aws:s3:::dst"},
+		{name: "object ARN", in: "arn:aws:s3:::src/logs/*", want: "arn:aws:s3:::dst/logs/*"},
+		{name: "other partition", in: "arn:aws-cn:s3:::src/*", want: "arn:aws-cn:s3:::dst/*"},
+		{name: "bucket sharing the prefix", in: "arn:aws:s3:::src-archive/*", want: "arn:aws:s3:::src-archive/*"},
+		{name: "other service", in: "arn:aws:iam::111122223333:role/src", want: "arn:aws:iam::111122223333:role/src"},
+		{name: "plain string", in: "src", want: "src"},
+		{
+			name: "nested values",
+			in: map[string]interface{}{
+				"Resource":  []interface{}{"arn:aws:s3:::src", "arn:aws:s3:::src/*"},
+				"Condition": map[string]interface{}{"ArnLike": map[string]interface{}{"aws:SourceArn": "arn:aws:s3:::src"}},
+				"Effect":    "Allow",
+			},
+			want: map[string]interface{}{
+				"Resource":  []interface{}{"arn:aws:s3:::dst", "arn:aws:s3:::dst/*"},
+				"Condition": map[string]interface{}{"ArnLike": map[string]interface{}{"aws:SourceArn": "arn:aws:s3:::dst"}},
+				"Effect":    "Allow",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rewriteBucketArns(tt.in, "src", "dst")
+			if changes := diffFields(tt.want, got); len(changes) > 0 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketPolicyFor(t *testing.T) {
+	statement := func(sid string, extra map[string]interface{}) map[string]interface{} {
+		st := map[string]interface{}{
+			"Sid":       sid,
+			"Effect":    "Allow",
+			"Principal": map[string]interface{}{"AWS": "arn:aws:iam::111122223333:root"},
+			"Action":    "s3:GetObject",
+			"Resource":  "arn:aws:s3:::src/*",
+		}
+		for k, v := range extra {
+			st[k] = v
+		}
+		return st
+	}
+	srcPolicy := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []interface{}{
+			statement("Read", nil),
+			statement(replicationSidBase+sidFor("other")+"Objects", nil),
+			statement("FromVpce", map[string]interface{}{"Condition": map[string]interface{}{
+				"StringEquals": map[string]interface{}{"aws:SourceVpce": "vpce-1a2b3c4d"},
+			}}),
+			statement("Public", map[string]interface{}{"Principal": "*"}),
+		},
+	}
+	dstPolicy := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []interface{}{
+			map[string]interface{}{"Sid": "Read", "Effect": "Allow", "Resource": "arn:aws:s3:::dst/old/*"},
+			map[string]interface{}{"Sid": "DestinationOnly", "Effect": "Deny"},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		dstRegion   string
+		blockPublic bool
+		wantSids    []string
+		wantSkipped int
+	}{
+		{
+			name:      "same region copies everything but replication statements",
+			dstRegion: "us-east-1",
+			wantSids:  []string{"Read", "DestinationOnly", "FromVpce", "Public"},
+		},
+		{
+			name:        "other region leaves out regional statements",
+			dstRegion:   "eu-west-1",
+			wantSids:    []string{"Read", "DestinationOnly", "Public"},
+			wantSkipped: 1,
+		},
+		{
+			name:        "Block Public Access leaves out public statements",
+			dstRegion:   "us-east-1",
+			blockPublic: true,
+			wantSids:    []string{"Read", "DestinationOnly", "FromVpce"},
+			wantSkipped: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &bucketConfig{Bucket: "src", Region: "us-east-1", Policy: srcPolicy}
+			got, skipped := bucketPolicyFor(cfg, dstPolicy, "dst", tt.dstRegion, tt.blockPublic)
+			if len(skipped) != tt.wantSkipped {
+				t.Errorf("got skipped %v, want %d", skipped, tt.wantSkipped)
+			}
+			if sids := statementSids(got); strings.Join(sids, ",") != strings.Join(tt.wantSids, ",") {
+				t.Errorf("got Sids %v, want %v", sids, tt.wantSids)
+			}
+			// The copied statement replaces the destination's one with the same Sid and points at dst
+			read, _ := got["Statement"].([]interface{})[0].(map[string]interface{})
+			if read["Resource"] != "arn:aws:s3:::dst/*" {
+				t.Errorf("statement Read has resource %v, want arn:aws:s3:::dst/*", read["Resource"])
+			}
+		})
+	}
+}
@@ -2,17 +2,26 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math/rand"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
 )
 
 func main() {
@@ -23,6 +32,9 @@ func main() {
 	dstRegion := flag.String("dest-region", "us-west-2", "Destination bucket region")
 	roleName := flag.String("role-name", "s3-replication-role-example", "IAM Role name for replication")
 	profile := flag.String("profile", "", "AWS profile to use (optional)")
+	deleteMarkers := flag.Bool("delete-marker-replication", false, "Replicate delete markers to the destination")
+	existingObjects := flag.Bool("existing-object-replication", false, "Replicate objects that existed before the rule was created")
+	propagationTimeout := flag.Duration("propagation-timeout", 2*time.Minute, "How long to retry PutBucketReplication while a new role propagates")
 	flag.Parse()
 
 	if *srcBucket == "" || *dstBucket == "" {
@@ -47,11 +59,20 @@ func main() {
 
 	fmt.Printf("Setting up replication from %s (%s) -> %s (%s)\n", *srcBucket, *srcRegion, *dstBucket, *dstRegion)
 
-	// 1) Create destination bucket if not exists
-	err := ensureBucketExists(s3Dst, *dstBucket, *dstRegion)
+	// 1) Create destination bucket if not exists, or check the settings of the existing one
+	created, err := ensureBucketExists(s3Dst, *dstBucket, *dstRegion)
 	if err != nil {
 		log.Fatalf("Failed ensuring destination bucket: %v", err)
 	}
+	if !created {
+		drift, err := checkBucketDefaults(s3Dst, *dstBucket)
+		if err != nil {
+			log.Fatalf("Failed checking destination bucket settings: %v", err)
+		}
+		if len(drift) > 0 {
+			fmt.Printf("Warning: destination bucket %s differs from the bucket defaults:\n  %s\n", *dstBucket, strings.Join(drift, "\n  "))
+		}
+	}
 	fmt.Println("Destination bucket exists/ready.")
 
 	// 2) Enable versioning on both buckets
@@ -65,15 +86,19 @@ func main() {
 	}
 	fmt.Println("Versioning enabled on destination bucket.")
 
-	// 3) Create IAM role for replication
-	roleArn, err := ensureReplicationRole(iamSvc, *roleName, *srcBucket, *dstBucket, *dstRegion)
+	// 3) Create IAM role for replication, which S3 may only assume for the source bucket in this account
+	account, err := callerAccount(sts.New(srcSess))
+	if err != nil {
+		log.Fatalf("Failed to look up the AWS account: %v", err)
+	}
+	roleArn, err := ensureReplicationRole(iamSvc, *roleName, account, *srcBucket, *dstBucket, *dstRegion, *deleteMarkers)
 	if err != nil {
 		log.Fatalf("Failed to ensure IAM replication role: %v", err)
 	}
 	fmt.Printf("Replication role ready: %s\n", roleArn)
 
 	// 4) Put replication configuration on source bucket
-	if err := putReplicationConfiguration(s3Src, *srcBucket, *dstBucket, roleArn); err != nil {
+	if err := putReplicationConfiguration(s3Src, *srcBucket, *dstBucket, partitionFor(*srcRegion), roleArn, *deleteMarkers, *existingObjects, *propagationTimeout); err != nil {
 		log.Fatalf("Failed to put replication configuration: %v", err)
 	}
 	fmt.Println("Replication configuration applied to source bucket.")
@@ -81,14 +106,15 @@ func main() {
 	fmt.Println("Cross-region replication setup complete.")
 }
 
-// ensureBucketExists creates a bucket if it doesn't exist.
+// ensureBucketExists creates a bucket with Block Public Access, BucketOwnerEnforced object ownership and SSE-S3
+// default encryption if it doesn't exist, and reports whether it did.
 // For non-us-east-1 regions, LocationConstraint must be set.
-func ensureBucketExists(s3client *s3.S3, bucketName, region string) error {
+func ensureBucketExists(s3client *s3.S3, bucketName, region string) (bool, error) {
 	// Check head bucket
 	_, err := s3client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucketName)})
 	if err == nil {
 		// exists and accessible
-		return nil
+		return false, nil
 	}
 
 	// If HeadBucket error indicates not found or forbidden, try to create
@@ -112,21 +138,90 @@ func ensureBucketExists(s3client *s3.S3, bucketName, region string) error {
 		// If bucket already exists and is owned by you, treat as ok; otherwise fail
 		if aerr, ok := err.(awserr.Error); ok {
 			if aerr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou {
-				return nil
+				return false, nil
 			}
 			if aerr.Code() == s3.ErrCodeBucketAlreadyExists {
-				return fmt.Errorf("bucket %s already exists and is owned by another account", bucketName)
+				return false, fmt.Errorf("bucket %s already exists and is owned by another account", bucketName)
 			}
 		}
-		return err
+		return false, err
 	}
 
 	// Wait until bucket exists
 	err = s3client.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: aws.String(bucketName)})
 	if err != nil {
-		return fmt.Errorf("bucket creation started but wait failed: %w", err)
+		return true, fmt.Errorf("bucket creation started but wait failed: %w", err)
 	}
-	return nil
+
+	_, err = s3client.PutPublicAccessBlock(&s3.PutPublicAccessBlockInput{
+		Bucket: aws.String(bucketName),
+		PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       aws.Bool(true),
+			IgnorePublicAcls:      aws.Bool(true),
+			BlockPublicPolicy:     aws.Bool(true),
+			RestrictPublicBuckets: aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return true, fmt.Errorf("PutPublicAccessBlock failed: %w", err)
+	}
+	_, err = s3client.PutBucketOwnershipControls(&s3.PutBucketOwnershipControlsInput{
+		Bucket: aws.String(bucketName),
+		OwnershipControls: &s3.OwnershipControls{Rules: []*s3.OwnershipControlsRule{
+			{ObjectOwnership: aws.String(s3.ObjectOwnershipBucketOwnerEnforced)},
+		}},
+	})
+	if err != nil {
+		return true, fmt.Errorf("PutBucketOwnershipControls failed: %w", err)
+	}
+	_, err = s3client.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+		Bucket: aws.String(bucketName),
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{Rules: []*s3.ServerSideEncryptionRule{{
+			ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{SSEAlgorithm: aws.String(s3.ServerSideEncryptionAes256)},
+		}}},
+	})
+	if err != nil {
+		return true, fmt.Errorf("PutBucketEncryption failed: %w", err)
+	}
+	return true, nil
+}
+
+// checkBucketDefaults lists how an existing bucket differs from the settings ensureBucketExists gives new buckets.
+func checkBucketDefaults(s3client *s3.S3, bucketName string) ([]string, error) {
+	var drift []string
+	notFound := func(err error, code string) bool {
+		aerr, ok := err.(awserr.Error)
+		return ok && aerr.Code() == code
+	}
+
+	pab, err := s3client.GetPublicAccessBlock(&s3.GetPublicAccessBlockInput{Bucket: aws.String(bucketName)})
+	if err != nil && !notFound(err, "NoSuchPublicAccessBlockConfiguration") {
+		return nil, fmt.Errorf("GetPublicAccessBlock failed: %w", err)
+	}
+	if err != nil || pab.PublicAccessBlockConfiguration == nil {
+		drift = append(drift, "Block Public Access: not configured")
+	} else if c := pab.PublicAccessBlockConfiguration; !aws.BoolValue(c.BlockPublicAcls) || !aws.BoolValue(c.IgnorePublicAcls) ||
+		!aws.BoolValue(c.BlockPublicPolicy) || !aws.BoolValue(c.RestrictPublicBuckets) {
+		drift = append(drift, "Block Public Access: not all settings are on")
+	}
+
+	oc, err := s3client.GetBucketOwnershipControls(&s3.GetBucketOwnershipControlsInput{Bucket: aws.String(bucketName)})
+	if err != nil && !notFound(err, "OwnershipControlsNotFoundError") {
+		return nil, fmt.Errorf("GetBucketOwnershipControls failed: %w", err)
+	}
+	if err != nil || oc.OwnershipControls == nil || len(oc.OwnershipControls.Rules) == 0 ||
+		aws.StringValue(oc.OwnershipControls.Rules[0].ObjectOwnership) != s3.ObjectOwnershipBucketOwnerEnforced {
+		drift = append(drift, "Object ownership: not "+s3.ObjectOwnershipBucketOwnerEnforced)
+	}
+
+	_, err = s3client.GetBucketEncryption(&s3.GetBucketEncryptionInput{Bucket: aws.String(bucketName)})
+	if err != nil && !notFound(err, "ServerSideEncryptionConfigurationNotFoundError") {
+		return nil, fmt.Errorf("GetBucketEncryption failed: %w", err)
+	}
+	if err != nil {
+		drift = append(drift, "Default encryption: not configured")
+	}
+	return drift, nil
 }
 
 // enableBucketVersioning enables versioning on the given bucket.
@@ -141,105 +236,339 @@ func enableBucketVersioning(s3client *s3.S3, bucketName string) error {
 }
 
 // ensureReplicationRole creates (or returns existing) an IAM role for S3 replication and attaches an inline policy.
-// The role's trust policy allows the S3 service to assume it.
-func ensureReplicationRole(iamSvc *iam.IAM, roleName, srcBucket, dstBucket, dstRegion string) (string, error) {
-	assumeRolePolicy := map[string]interface{}{
-		"Version": "2012-10-17",
-		"Statement": []map[string]interface{}{
-			{
-				"Effect": "Allow",
-				"Principal": map[string]interface{}{
-					"Service": "s3.amazonaws.com",
-				},
-				"Action": "sts:AssumeRole",
-			},
-		},
-	}
-	assumePolicyBytes, _ := json.Marshal(assumeRolePolicy)
+// The role's trust policy allows the S3 service to assume it on behalf of srcBucket in account only; on an
+// existing role, the source buckets already trusted stay. On an existing role, the trust policy and the
+// inline policy are compared with the expected ones and updated if they differ. The inline policy's statements
+// carry Sids built from the bucket names, so only the statements for this source and destination are replaced
+// and other sources sharing the role keep their permissions.
+// s3:ReplicateDelete is only granted when delete markers are replicated.
+func ensureReplicationRole(iamSvc *iam.IAM, roleName, account, srcBucket, dstBucket, dstRegion string, deleteMarkers bool) (string, error) {
+	// Both buckets are in the destination region's partition; replication never crosses partitions
+	partition := partitionFor(dstRegion)
+	srcArn := fmt.Sprintf("arn:%s:s3:::%s", partition, srcBucket)
+
+	assumePolicyBytes, _ := json.Marshal(trustPolicyDocument(account, []string{srcArn}))
 
 	createRoleOutput, err := iamSvc.CreateRole(&iam.CreateRoleInput{
 		RoleName:                 aws.String(roleName),
 		AssumeRolePolicyDocument: aws.String(string(assumePolicyBytes)),
 		Description:              aws.String("Role for S3 cross-region replication"),
 	})
+	var roleArn string
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			// If role already exists, retrieve it
-			if aerr.Code() == iam.ErrCodeEntityAlreadyExistsException {
-				// Get role
-				out, gerr := iamSvc.GetRole(&iam.GetRoleInput{RoleName: aws.String(roleName)})
-				if gerr != nil {
-					return "", fmt.Errorf("role exists but failed to get role: %w", gerr)
-				}
-				return aws.StringValue(out.Role.Arn), nil
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != iam.ErrCodeEntityAlreadyExistsException {
+			return "", fmt.Errorf("CreateRole error: %w", err)
+		}
+		// Role already exists: retrieve it and bring its trust policy up to date
+		out, gerr := iamSvc.GetRole(&iam.GetRoleInput{RoleName: aws.String(roleName)})
+		if gerr != nil {
+			return "", fmt.Errorf("role exists but failed to get role: %w", gerr)
+		}
+		roleArn = aws.StringValue(out.Role.Arn)
+		current := aws.StringValue(out.Role.AssumeRolePolicyDocument)
+		doc, err := parsePolicyDocument(current)
+		if err != nil {
+			return "", fmt.Errorf("trust policy of role %s: %w", roleName, err)
+		}
+		desired := desiredTrustPolicy(doc, account, srcArn)
+		changed, err := policyDiffers(current, desired)
+		if err != nil {
+			return "", fmt.Errorf("trust policy of role %s: %w", roleName, err)
+		}
+		if changed {
+			desiredBytes, _ := json.Marshal(desired)
+			_, err := iamSvc.UpdateAssumeRolePolicy(&iam.UpdateAssumeRolePolicyInput{
+				RoleName:       aws.String(roleName),
+				PolicyDocument: aws.String(string(desiredBytes)),
+			})
+			if err != nil {
+				return "", fmt.Errorf("UpdateAssumeRolePolicy failed: %w", err)
 			}
+			fmt.Printf("Updated trust policy of existing role %s.\n", roleName)
 		}
-		return "", fmt.Errorf("CreateRole error: %w", err)
+	} else {
+		roleArn = aws.StringValue(createRoleOutput.Role.Arn)
 	}
 
-	roleArn := aws.StringValue(createRoleOutput.Role.Arn)
+	dstActions := []string{"s3:ReplicateObject"}
+	if deleteMarkers {
+		dstActions = append(dstActions, "s3:ReplicateDelete")
+	}
+	dstActions = append(dstActions,
+		"s3:ReplicateTags",
+		"s3:PutObjectAcl",
+		"s3:PutObjectVersionAcl",
+		"s3:PutObjectVersionTagging",
+		"s3:PutObject",
+	)
 
-	// Attach inline policy that allows S3 to replicate from source to destination.
-	// Policy gives S3 permissions to read the source object versions and write to destination bucket.
+	// Merge statements into the inline policy that allow S3 to replicate from source to destination.
+	// They give S3 permissions to read the source object versions and write to destination bucket.
 	// NOTE: Adjust policy if you use KMS or need additional permissions.
-	policy := map[string]interface{}{
-		"Version": "2012-10-17",
-		"Statement": []map[string]interface{}{
-			{
-				"Effect": "Allow",
-				"Action": []string{
-					"s3:GetObjectVersion",
-					"s3:GetObjectVersionAcl",
-					"s3:GetObjectVersionTagging",
-					"s3:GetObjectVersionForReplication",
-					"s3:ListBucket",
-					"s3:GetReplicationConfiguration",
-				},
-				"Resource": []string{
-					fmt.Sprintf("arn:aws:s3:::%s", srcBucket),
-					fmt.Sprintf("arn:aws:s3:::%s/*", srcBucket),
-				},
+	statements := []interface{}{
+		map[string]interface{}{
+			"Sid":    "ReadFrom" + sidFor(srcBucket),
+			"Effect": "Allow",
+			"Action": []string{
+				"s3:GetObjectVersion",
+				"s3:GetObjectVersionAcl",
+				"s3:GetObjectVersionTagging",
+				"s3:GetObjectVersionForReplication",
+				"s3:ListBucket",
+				"s3:GetReplicationConfiguration",
 			},
-			{
-				"Effect": "Allow",
-				"Action": []string{
-					"s3:ReplicateObject",
-					"s3:ReplicateDelete",
-					"s3:ReplicateTags",
-					"s3:PutObjectAcl",
-					"s3:PutObjectVersionAcl",
-					"s3:PutObjectVersionTagging",
-					"s3:PutObject",
-				},
-				"Resource": []string{
-					fmt.Sprintf("arn:aws:s3:::%s", dstBucket),
-					fmt.Sprintf("arn:aws:s3:::%s/*", dstBucket),
-				},
+			"Resource": []string{
+				fmt.Sprintf("arn:%s:s3:::%s", partition, srcBucket),
+				fmt.Sprintf("arn:%s:s3:::%s/*", partition, srcBucket),
+			},
+		},
+		map[string]interface{}{
+			"Sid":    "Replicate" + sidFor(srcBucket) + "To" + sidFor(dstBucket),
+			"Effect": "Allow",
+			"Action": dstActions,
+			"Resource": []string{
+				fmt.Sprintf("arn:%s:s3:::%s", partition, dstBucket),
+				fmt.Sprintf("arn:%s:s3:::%s/*", partition, dstBucket),
 			},
 		},
 	}
 
+	policyName := roleName + "-inline-policy"
+	current, err := iamSvc.GetRolePolicy(&iam.GetRolePolicyInput{
+		RoleName:   aws.String(roleName),
+		PolicyName: aws.String(policyName),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != iam.ErrCodeNoSuchEntityException {
+			return "", fmt.Errorf("GetRolePolicy failed: %w", err)
+		}
+		current = nil
+	}
+	// The role may be shared with other sources; their statements in the policy are kept
+	policy := map[string]interface{}{"Version": "2012-10-17", "Statement": statements}
+	changed := true
+	if current != nil {
+		doc, err := parsePolicyDocument(aws.StringValue(current.PolicyDocument))
+		if err != nil {
+			return "", fmt.Errorf("inline policy %s: %w", policyName, err)
+		}
+		policy = mergePolicyStatements(doc, statements)
+		if changed, err = policyDiffers(aws.StringValue(current.PolicyDocument), policy); err != nil {
+			return "", fmt.Errorf("inline policy %s: %w", policyName, err)
+		}
+	}
+	if !changed {
+		fmt.Printf("Inline policy %s is up to date.\n", policyName)
+		return roleArn, nil
+	}
+
 	policyBytes, _ := json.Marshal(policy)
 	_, err = iamSvc.PutRolePolicy(&iam.PutRolePolicyInput{
 		RoleName:       aws.String(roleName),
-		PolicyName:     aws.String(roleName + "-inline-policy"),
+		PolicyName:     aws.String(policyName),
 		PolicyDocument: aws.String(string(policyBytes)),
 	})
 	if err != nil {
 		return "", fmt.Errorf("failed to put role policy: %w", err)
 	}
-
-	// Wait a bit for IAM propagation (IAM can be eventually consistent). Small sleep helps avoid immediate use errors.
-	time.Sleep(5 * time.Second)
+	if current != nil {
+		fmt.Printf("Updated inline policy %s.\n", policyName)
+	}
 
 	return roleArn, nil
 }
 
-// putReplicationConfiguration configures a replication rule on the source bucket to the destination bucket.
-func putReplicationConfiguration(s3client *s3.S3, srcBucket, dstBucket, roleArn string) error {
+// trustPolicyDocument is the assume-role policy of the replication role. To protect against the confused deputy
+// problem, S3 may only assume the role on behalf of the given source buckets in account.
+func trustPolicyDocument(account string, sourceArns []string) map[string]interface{} {
+	return map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{
+			{
+				"Effect": "Allow",
+				"Principal": map[string]interface{}{
+					"Service": "s3.amazonaws.com",
+				},
+				"Action": "sts:AssumeRole",
+				"Condition": map[string]interface{}{
+					"StringEquals": map[string]interface{}{"aws:SourceAccount": account},
+					"ArnLike":      map[string]interface{}{"aws:SourceArn": sourceArns},
+				},
+			},
+		},
+	}
+}
+
+// desiredTrustPolicy is the trust policy a role should have once the source bucket srcArn uses it: the source
+// ARNs already in the current trust policy stay, so that sources sharing the role keep working. Only the statement
+// letting S3 assume the role is written; other statements, such as one for S3 Batch Operations, are kept as they are.
+func desiredTrustPolicy(doc map[string]interface{}, account, srcArn string) map[string]interface{} {
+	arns := map[string]bool{srcArn: true}
+	statements, _ := doc["Statement"].([]interface{})
+	if st, ok := doc["Statement"].(map[string]interface{}); ok {
+		statements = []interface{}{st}
+	}
+	for _, st := range statements {
+		m, _ := st.(map[string]interface{})
+		if !isS3TrustStatement(m) {
+			continue
+		}
+		cond, _ := m["Condition"].(map[string]interface{})
+		arnLike, _ := cond["ArnLike"].(map[string]interface{})
+		switch v := arnLike["aws:SourceArn"].(type) {
+		case string:
+			arns[v] = true
+		case []interface{}:
+			for _, a := range v {
+				if s, ok := a.(string); ok {
+					arns[s] = true
+				}
+			}
+		}
+	}
+	list := make([]string, 0, len(arns))
+	for a := range arns {
+		list = append(list, a)
+	}
+	sort.Strings(list)
+	desired := trustPolicyDocument(account, list)
+
+	// The S3 statement takes the place of the first existing one; further S3 statements are merged into it
+	s3Statement := desired["Statement"].([]map[string]interface{})[0]
+	var merged []interface{}
+	placed := false
+	for _, st := range statements {
+		m, _ := st.(map[string]interface{})
+		if !isS3TrustStatement(m) {
+			merged = append(merged, st)
+			continue
+		}
+		if !placed {
+			merged = append(merged, s3Statement)
+			placed = true
+		}
+	}
+	if !placed {
+		merged = append([]interface{}{s3Statement}, merged...)
+	}
+	desired["Statement"] = merged
+	if v, ok := doc["Version"]; ok {
+		desired["Version"] = v
+	}
+	return desired
+}
+
+// isS3TrustStatement reports whether a trust policy statement lets the S3 service assume the role.
+func isS3TrustStatement(statement map[string]interface{}) bool {
+	if effect, _ := statement["Effect"].(string); effect != "Allow" {
+		return false
+	}
+	principal, _ := statement["Principal"].(map[string]interface{})
+	return policyValueContains(principal["Service"], "s3.amazonaws.com") && policyValueContains(statement["Action"], "sts:AssumeRole")
+}
+
+// policyValueContains reports whether a policy element, a string or a list of strings, contains s.
+func policyValueContains(v interface{}, s string) bool {
+	switch t := v.(type) {
+	case string:
+		return t == s
+	case []interface{}:
+		for _, e := range t {
+			if e == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mergePolicyStatements returns current with the statements replaced that have the Sid of one of statements,
+// and the remaining statements appended. Statements without Sid, written by earlier versions, are replaced
+// when they grant on exactly the resources of one of statements. All other statements are kept.
+func mergePolicyStatements(current map[string]interface{}, statements []interface{}) map[string]interface{} {
+	sids := make(map[string]bool)
+	resources := make(map[string]bool)
+	for _, st := range statements {
+		m := st.(map[string]interface{})
+		sids[m["Sid"].(string)] = true
+		r, _ := json.Marshal(m["Resource"])
+		resources[string(r)] = true
+	}
+	existing, _ := current["Statement"].([]interface{})
+	if st, ok := current["Statement"].(map[string]interface{}); ok {
+		existing = []interface{}{st}
+	}
+	var merged []interface{}
+	for _, st := range existing {
+		m, _ := st.(map[string]interface{})
+		sid, _ := m["Sid"].(string)
+		r, _ := json.Marshal(m["Resource"])
+		if sids[sid] || (sid == "" && resources[string(r)]) {
+			continue
+		}
+		merged = append(merged, st)
+	}
+	out := map[string]interface{}{"Version": "2012-10-17", "Statement": append(merged, statements...)}
+	if v, ok := current["Version"]; ok {
+		out["Version"] = v
+	}
+	return out
+}
+
+// sidFor builds the Sid fragment for a bucket: the characters of its name allowed in a Sid, followed by a short
+// hash of the full name, so that names differing only in '-' or '.' do not share a Sid.
+func sidFor(bucket string) string {
+	var b strings.Builder
+	for _, c := range bucket {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(bucket))
+	return fmt.Sprintf("%s%08x", b.String(), h.Sum32())
+}
+
+// parsePolicyDocument decodes a policy document as returned by IAM (URL-encoded JSON).
+func parsePolicyDocument(current string) (map[string]interface{}, error) {
+	decoded, err := url.QueryUnescape(current)
+	if err != nil {
+		return nil, fmt.Errorf("decode policy document: %w", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(decoded), &doc); err != nil {
+		return nil, fmt.Errorf("parse policy document: %w", err)
+	}
+	return doc, nil
+}
+
+// policyDiffers reports whether a policy document as returned by IAM (URL-encoded JSON) differs from desired.
+func policyDiffers(current string, desired interface{}) (bool, error) {
+	decoded, err := url.QueryUnescape(current)
+	if err != nil {
+		return false, fmt.Errorf("decode policy document: %w", err)
+	}
+	var got, want interface{}
+	if err := json.Unmarshal([]byte(decoded), &got); err != nil {
+		return false, fmt.Errorf("parse policy document: %w", err)
+	}
+	// Round-trip desired through JSON so both sides use the same types
+	desiredBytes, _ := json.Marshal(desired)
+	if err := json.Unmarshal(desiredBytes, &want); err != nil {
+		return false, err
+	}
+	return !reflect.DeepEqual(got, want), nil
+}
+
+// putReplicationConfiguration configures a replication rule on the source bucket to the destination bucket,
+// whose ARN is built in partition. deleteMarkers and existingObjects turn on delete marker and existing object
+// replication for the rule. While a role created or changed moments ago cannot be used by S3 yet, the call is
+// retried until timeout.
+func putReplicationConfiguration(s3client *s3.S3, srcBucket, dstBucket, partition, roleArn string, deleteMarkers, existingObjects bool, timeout time.Duration) error {
 	// Build the replication config:
 	// A single rule that replicates everything (empty prefix) and is enabled.
-	dstARN := fmt.Sprintf("arn:aws:s3:::%s", dstBucket)
+	dstARN := fmt.Sprintf("arn:%s:s3:::%s", partition, dstBucket)
 
 	// Prepare destination
 	destination := &s3.Destination{
@@ -259,18 +588,92 @@ func putReplicationConfiguration(s3client *s3.S3, srcBucket, dstBucket, roleArn
 			Status: aws.String("Disabled"),
 		},
 	}
+	if deleteMarkers {
+		rule.DeleteMarkerReplication.Status = aws.String("Enabled")
+	}
+	if existingObjects {
+		rule.ExistingObjectReplication = &s3.ExistingObjectReplication{Status: aws.String("Enabled")}
+	}
 
 	configuration := &s3.ReplicationConfiguration{
 		Role:  aws.String(roleArn),
 		Rules: []*s3.ReplicationRule{rule},
 	}
 
-	_, err := s3client.PutBucketReplication(&s3.PutBucketReplicationInput{
-		Bucket:                   aws.String(srcBucket),
-		ReplicationConfiguration: configuration,
+	err := retryPropagation("PutBucketReplication on "+srcBucket, timeout, replicationPropagationCodes, func() error {
+		_, err := s3client.PutBucketReplication(&s3.PutBucketReplicationInput{
+			Bucket:                   aws.String(srcBucket),
+			ReplicationConfiguration: configuration,
+		})
+		return err
 	})
 	if err != nil {
 		return fmt.Errorf("PutBucketReplication failed: %w", err)
 	}
 	return nil
 }
+
+// replicationPropagationCodes are the errors PutBucketReplication returns while the role cannot be assumed yet, or
+// the destination's versioning is not visible yet. "Code:fragment" only matches errors with that code whose
+// lowercased message contains fragment; S3 returns InvalidRequest for any invalid configuration too.
+var replicationPropagationCodes = []string{"AccessDenied", "InvalidRequest:role", "InvalidRequest:versioning"}
+
+// retryPropagation calls fn until it succeeds, fails with an error not matching codes, or timeout has
+// passed. Between attempts it sleeps with exponential backoff and full jitter. When fn had to be retried, the
+// time it took for the change to propagate is printed.
+func retryPropagation(what string, timeout time.Duration, codes []string, fn func() error) error {
+	start := time.Now()
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				fmt.Printf("%s succeeded after waiting %s for propagation (%d attempts).\n", what, time.Since(start).Round(100*time.Millisecond), attempt)
+			}
+			return nil
+		}
+		var aerr awserr.Error
+		retryable := false
+		if errors.As(err, &aerr) {
+			for _, c := range codes {
+				code, fragment, _ := strings.Cut(c, ":")
+				if aerr.Code() == code && strings.Contains(strings.ToLower(aerr.Message()), fragment) {
+					retryable = true
+				}
+			}
+		}
+		remaining := timeout - time.Since(start)
+		if !retryable || remaining <= 0 {
+			if retryable {
+				return fmt.Errorf("%s: still failing after %s: %w", what, timeout, err)
+			}
+			return err
+		}
+		sleep := time.Duration(rand.Int63n(int64(backoff)))
+		if sleep > remaining {
+			sleep = remaining
+		}
+		fmt.Printf("%s failed with %s, retrying in %s...\n", what, aerr.Code(), sleep.Round(100*time.Millisecond))
+		time.Sleep(sleep)
+		if backoff < 16*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// callerAccount returns the account ID of the credentials in use.
+func callerAccount(stsSvc *sts.STS) (string, error) {
+	out, err := stsSvc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("GetCallerIdentity failed: %w", err)
+	}
+	return aws.StringValue(out.Account), nil
+}
+
+// partitionFor returns the partition of a region, e.g. aws, aws-cn or aws-us-gov.
+func partitionFor(region string) string {
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return p.ID()
+	}
+	return endpoints.AwsPartitionID
+}
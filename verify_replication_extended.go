@@ -5,19 +5,71 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+// ruleFilter is the part of a replication rule that decides which objects it replicates,
+// along with the rule's priority and the storage class its replicas get ("" keeps the source class).
+type ruleFilter struct {
+	Prefix       string
+	Tags         map[string]string
+	Priority     int64
+	StorageClass string
+}
+
+// matches reports whether an object with the given key and tags is selected by the filter.
+func (f ruleFilter) matches(key string, tags map[string]string) bool {
+	if !strings.HasPrefix(key, f.Prefix) {
+		return false
+	}
+	for k, v := range f.Tags {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// tagFlag collects repeated --tag key=value flags.
+type tagFlag map[string]string
+
+func (t tagFlag) String() string {
+	var pairs []string
+	for k, v := range t {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (t tagFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	t[k] = v
+	return nil
+}
+
 func main() {
 	// Flags
 	srcBucket := flag.String("source-bucket", "", "Source bucket name (required)")
 	srcRegion := flag.String("source-region", "us-east-1", "Source bucket region")
 	profile := flag.String("profile", "", "AWS profile to use (optional)")
 	key := flag.String("key", "replication-test-ss.txt", "Object key to use for verification")
+	probeTags := tagFlag{}
+	flag.Var(probeTags, "tag", "Tag to put on the test object, as key=value (repeatable)")
+	bidirectional := flag.Bool("bidirectional", false, "Also probe replication from each destination to its own destinations (both directions, or every edge of a mesh)")
+	ep := addEndpointFlags(flag.CommandLine)
 	flag.Parse()
 
 	if *srcBucket == "" {
@@ -25,43 +77,79 @@ func main() {
 	}
 
 	// Create session for source region
-	srcSess := session.Must(session.NewSessionWithOptions(session.Options{
-		Config:            aws.Config{Region: aws.String(*srcRegion)},
-		Profile:           *profile,
-		SharedConfigState: session.SharedConfigEnable,
-	}))
+	srcSess := newSession(*srcRegion, *profile, ep)
 	s3Src := s3.New(srcSess)
 
+	destBuckets := verifySource(s3Src, *srcBucket, *srcRegion, *profile, ep, *key, probeTags)
+	if !*bidirectional {
+		return
+	}
+
+	// Probe the reverse direction with a fresh object: replicas are never replicated again,
+	// so the object already copied to the destination would not travel back
+	for _, dstBucket := range destBuckets {
+		fmt.Printf("\n=== Reverse direction: %s -> %s ===\n", dstBucket, *srcBucket)
+		detectedRegion := bucketRegion(s3Src, dstBucket, *srcRegion)
+		s3Dst := s3.New(newSession(detectedRegion, *profile, ep))
+		reverseKey := *key + ".from-" + dstBucket
+		verifySource(s3Dst, dstBucket, detectedRegion, *profile, ep, reverseKey, probeTags)
+	}
+}
+
+// verifySource uploads a test object to a source bucket, waits for it in every destination its rules select
+// and compares the objects in each destination with the source. Destination sessions use profile and ep.
+// It returns the destination buckets.
+func verifySource(s3Src *s3.S3, srcBucket, srcRegion, profile string, ep *endpointOptions, key string, probeTags tagFlag) []string {
 	// Step 1: Upload to source bucket
 	content := []byte("Hello extended replication test from Go SDK v1. Hello to CRR! Bye.")
-	_, err := s3Src.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(*srcBucket),
-		Key:    key,
+	putInput := &s3.PutObjectInput{
+		Bucket: aws.String(srcBucket),
+		Key:    aws.String(key),
 		Body:   bytes.NewReader(content),
-	})
+	}
+	if len(probeTags) > 0 {
+		tagging := url.Values{}
+		for k, v := range probeTags {
+			tagging.Set(k, v)
+		}
+		putInput.Tagging = aws.String(tagging.Encode())
+	}
+	uploadedAt := time.Now()
+	_, err := s3Src.PutObject(putInput)
 	if err != nil {
 		log.Fatalf("Failed to upload object to source bucket: %v", err)
 	}
-	fmt.Printf("Uploaded object %s to source bucket %s\n", *key, *srcBucket)
+	fmt.Printf("Uploaded object %s to source bucket %s\n", key, srcBucket)
 
-	// Step 2: Get all destination buckets from replication rules
+	// Step 2: Get all destination buckets and their filters from replication rules
 	getOut, err := s3Src.GetBucketReplication(&s3.GetBucketReplicationInput{
-		Bucket: aws.String(*srcBucket),
+		Bucket: aws.String(srcBucket),
 	})
 	if err != nil || getOut.ReplicationConfiguration == nil {
 		log.Fatalf("Failed to get replication configuration: %v", err)
 	}
 	var destBuckets []string
+	destFilters := make(map[string][]ruleFilter)
+	// Replication Time Control window per destination, zero when RTC is off
+	destRTC := make(map[string]time.Duration)
 	for _, rule := range getOut.ReplicationConfiguration.Rules {
+		if aws.StringValue(rule.Status) != "Enabled" {
+			continue
+		}
 		if rule.Destination != nil && rule.Destination.Bucket != nil {
-			// Destination bucket ARN: arn:aws:s3:::bucketname
-			arn := *rule.Destination.Bucket
-			// Extract bucket name from ARN
-			var bucketName string
-			_, err := fmt.Sscanf(arn, "arn:aws:s3:::%s", &bucketName)
-			if err == nil {
+			// Destination bucket ARN: arn:<partition>:s3:::bucketname
+			bucketName, err := bucketFromArn(*rule.Destination.Bucket)
+			if err != nil {
+				fmt.Printf("❌ Rule %s has a malformed destination: %v\n", aws.StringValue(rule.ID), err)
+				continue
+			}
+			if _, seen := destFilters[bucketName]; !seen {
 				destBuckets = append(destBuckets, bucketName)
 			}
+			destFilters[bucketName] = append(destFilters[bucketName], filterFromRule(rule))
+			if rt := rule.Destination.ReplicationTime; rt != nil && aws.StringValue(rt.Status) == "Enabled" && rt.Time != nil {
+				destRTC[bucketName] = time.Duration(aws.Int64Value(rt.Time.Minutes)) * time.Minute
+			}
 		}
 	}
 	if len(destBuckets) == 0 {
@@ -71,112 +159,366 @@ func main() {
 	// Step 3: For each destination bucket, check for replicated object
 	for _, dstBucket := range destBuckets {
 		fmt.Printf("\nChecking replication to destination bucket: %s\n", dstBucket)
-		// Detect region for destination bucket
-		detectedRegion := *srcRegion
-		// Use a generic session to get bucket location
-		genericSess := session.Must(session.NewSessionWithOptions(session.Options{
-			Config:            aws.Config{Region: aws.String(*srcRegion)},
-			Profile:           *profile,
-			SharedConfigState: session.SharedConfigEnable,
-		}))
-		genericS3 := s3.New(genericSess)
-		locOut, err := genericS3.GetBucketLocation(&s3.GetBucketLocationInput{
-			Bucket: aws.String(dstBucket),
-		})
-		if err == nil && locOut.LocationConstraint != nil {
-			detectedRegion = aws.StringValue(locOut.LocationConstraint)
-			if detectedRegion == "" {
-				detectedRegion = "us-east-1"
-			}
-			// AWS returns some regions as enums, e.g. EU, so handle that
-			if detectedRegion == "EU" {
-				detectedRegion = "eu-west-1"
-			}
+		for _, f := range destFilters[dstBucket] {
+			fmt.Printf("Rule filter: %s\n", describeFilter(f))
 		}
-		dstSess := session.Must(session.NewSessionWithOptions(session.Options{
-			Config:            aws.Config{Region: aws.String(detectedRegion)},
-			Profile:           *profile,
-			SharedConfigState: session.SharedConfigEnable,
-		}))
-		s3Dst := s3.New(dstSess)
+		if !matchesAny(destFilters[dstBucket], key, probeTags) {
+			fmt.Printf("Object %s does not match any rule for bucket %s, not expecting it there\n", key, dstBucket)
+			continue
+		}
+
+		detectedRegion := bucketRegion(s3Src, dstBucket, srcRegion)
+		s3Dst := s3.New(newSession(detectedRegion, profile, ep))
 
 		fmt.Printf("Using region %s for bucket %s\n", detectedRegion, dstBucket)
+		expectedClass := ""
+		if rule, ok := winningRule(destFilters[dstBucket], key, probeTags); ok {
+			expectedClass = rule.StorageClass
+		}
+		deadline := time.Now().Add(2 * time.Minute) // check up to 2 minutes
+		rtcWindow := destRTC[dstBucket]
+		if rtcWindow > 0 {
+			// With RTC, wait until the window since the upload has passed before calling it a failure
+			deadline = uploadedAt.Add(rtcWindow)
+			fmt.Printf("Replication Time Control is enabled, objects should arrive within %s\n", rtcWindow)
+		}
 		fmt.Println("Waiting for replication (may take 30–60 seconds)...")
 		found := false
-		for i := 0; i < 12; i++ { // check up to 2 minutes
+		var elapsed time.Duration
+		var replicaClass string
+		for i := 0; i == 0 || time.Now().Before(deadline); i++ { // check every 10 seconds, at least once
 			time.Sleep(10 * time.Second)
-			_, err := s3Dst.HeadObject(&s3.HeadObjectInput{
+			headOut, err := s3Dst.HeadObject(&s3.HeadObjectInput{
 				Bucket: aws.String(dstBucket),
-				Key:    key,
+				Key:    aws.String(key),
 			})
 			if err == nil {
 				found = true
+				elapsed = time.Since(uploadedAt)
+				replicaClass = storageClassOrStandard(aws.StringValue(headOut.StorageClass))
 				break
 			}
 			fmt.Printf("Check %d: object not replicated yet\n", i+1)
 		}
 
 		if found {
-			fmt.Printf("✅ Object %s replicated successfully to bucket %s\n", *key, dstBucket)
+			fmt.Printf("✅ Object %s replicated successfully to bucket %s after %s\n", key, dstBucket, elapsed.Round(time.Second))
+			if expectedClass != "" {
+				if replicaClass == expectedClass {
+					fmt.Printf("✅ Replica has the expected storage class %s\n", expectedClass)
+				} else {
+					fmt.Printf("❌ Replica has storage class %s, expected %s\n", replicaClass, expectedClass)
+				}
+			}
 		} else {
-			fmt.Printf("❌ Object %s did not replicate to bucket %s within timeout\n", *key, dstBucket)
+			fmt.Printf("❌ Object %s did not replicate to bucket %s within timeout\n", key, dstBucket)
+		}
+		if rtcWindow > 0 {
+			if found && elapsed <= rtcWindow {
+				fmt.Printf("✅ Arrived within the %s RTC window\n", rtcWindow)
+			} else {
+				fmt.Printf("❌ Did not arrive within the %s RTC window\n", rtcWindow)
+			}
 		}
 	}
 
 	// Step 4: List all objects in source bucket
 	fmt.Println("\nListing objects in source bucket:")
-	srcObjects, err := listObjects(s3Src, *srcBucket)
+	srcObjects, err := listObjects(s3Src, srcBucket)
 	if err != nil {
 		log.Fatalf("Failed to list source bucket: %v", err)
 	}
 	for _, obj := range srcObjects {
 		fmt.Printf("  %s\n", obj)
 	}
-	// List objects in each destination bucket
+	// Tags of source objects, fetched only when a rule filters on tags
+	tagCache := make(map[string]map[string]string)
+	objectTags := func(key string) map[string]string {
+		if tags, ok := tagCache[key]; ok {
+			return tags
+		}
+		tags, err := getObjectTags(s3Src, srcBucket, key)
+		if err != nil {
+			log.Fatalf("Failed to get tags of %s: %v", key, err)
+		}
+		tagCache[key] = tags
+		return tags
+	}
+
+	// List objects in each destination bucket and compare with the source objects its rules select
 	for _, dstBucket := range destBuckets {
-		// Detect region for destination bucket
-		detectedRegion := *srcRegion
-		genericSess := session.Must(session.NewSessionWithOptions(session.Options{
-			Config:            aws.Config{Region: aws.String(*srcRegion)},
-			Profile:           *profile,
-			SharedConfigState: session.SharedConfigEnable,
-		}))
-		genericS3 := s3.New(genericSess)
-		locOut, err := genericS3.GetBucketLocation(&s3.GetBucketLocationInput{
-			Bucket: aws.String(dstBucket),
-		})
-		if err == nil && locOut.LocationConstraint != nil {
-			detectedRegion = aws.StringValue(locOut.LocationConstraint)
-			if detectedRegion == "" {
-				detectedRegion = "us-east-1"
+		filters := destFilters[dstBucket]
+		needTags := false
+		for _, f := range filters {
+			if len(f.Tags) > 0 {
+				needTags = true
+			}
+		}
+		var expected []string
+		for _, obj := range srcObjects {
+			var tags map[string]string
+			if needTags {
+				tags = objectTags(obj)
 			}
-			if detectedRegion == "EU" {
-				detectedRegion = "eu-west-1"
+			if matchesAny(filters, obj, tags) {
+				expected = append(expected, obj)
 			}
 		}
-		dstSess := session.Must(session.NewSessionWithOptions(session.Options{
-			Config:            aws.Config{Region: aws.String(detectedRegion)},
-			Profile:           *profile,
-			SharedConfigState: session.SharedConfigEnable,
-		}))
-		s3Dst := s3.New(dstSess)
+
+		detectedRegion := bucketRegion(s3Src, dstBucket, srcRegion)
+		s3Dst := s3.New(newSession(detectedRegion, profile, ep))
 		fmt.Printf("\nListing objects in destination bucket: %s (region: %s)\n", dstBucket, detectedRegion)
 		dstObjects, err := listObjects(s3Dst, dstBucket)
 		if err != nil {
 			log.Fatalf("Failed to list destination bucket %s: %v", dstBucket, err)
 		}
+		present := make(map[string]bool, len(dstObjects))
 		for _, obj := range dstObjects {
 			fmt.Printf("  %s\n", obj)
+			present[obj] = true
 		}
-		fmt.Printf("\nSource bucket has %d objects, destination bucket %s has %d objects\n",
-			len(srcObjects), dstBucket, len(dstObjects))
-		if len(dstObjects) >= len(srcObjects) {
-			fmt.Println("✅ Destination bucket contains all (or more) objects.")
+		var missing []string
+		for _, obj := range expected {
+			if !present[obj] {
+				missing = append(missing, obj)
+			}
+		}
+		fmt.Printf("\nSource bucket has %d objects (%d matching the rules), destination bucket %s has %d objects\n",
+			len(srcObjects), len(expected), dstBucket, len(dstObjects))
+		if len(missing) == 0 {
+			fmt.Println("✅ Destination bucket contains all matching objects.")
 		} else {
-			fmt.Println("⚠️ Some objects may not yet have replicated.")
+			fmt.Printf("⚠️ %d matching object(s) may not yet have replicated:\n", len(missing))
+			for _, obj := range missing {
+				fmt.Printf("  %s\n", obj)
+			}
+		}
+
+		// Check the storage class of replicas where a rule sets one
+		checkClasses := false
+		for _, f := range filters {
+			if f.StorageClass != "" {
+				checkClasses = true
+			}
+		}
+		if !checkClasses {
+			continue
+		}
+		classes, err := listStorageClasses(s3Dst, dstBucket)
+		if err != nil {
+			log.Fatalf("Failed to list storage classes in %s: %v", dstBucket, err)
+		}
+		wrongClass := 0
+		for _, obj := range expected {
+			class, ok := classes[obj]
+			if !ok {
+				continue
+			}
+			var tags map[string]string
+			if needTags {
+				tags = objectTags(obj)
+			}
+			rule, _ := winningRule(filters, obj, tags)
+			if rule.StorageClass != "" && class != rule.StorageClass {
+				fmt.Printf("  %s has storage class %s, expected %s\n", obj, class, rule.StorageClass)
+				wrongClass++
+			}
+		}
+		if wrongClass == 0 {
+			fmt.Println("✅ All replicas have the expected storage class.")
+		} else {
+			fmt.Printf("❌ %d replica(s) have an unexpected storage class.\n", wrongClass)
 		}
 	}
 
+	return destBuckets
+}
+
+// newSession creates a session for the given region. Use SharedConfigState to allow profile usage.
+// ep sends the session's requests to other endpoints than AWS's own.
+func newSession(region, profile string, ep *endpointOptions) *session.Session {
+	return session.Must(session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Region:           aws.String(region),
+			EndpointResolver: ep.resolver(),
+			S3ForcePathStyle: aws.Bool(ep.ForcePathStyle),
+		},
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+}
+
+// endpointOptions point the sessions at S3-compatible endpoints such as LocalStack or MinIO instead of AWS.
+// URL is used in every region and Regions overrides it for single regions. ForcePathStyle addresses buckets
+// as <endpoint>/<bucket>, which local endpoints need.
+type endpointOptions struct {
+	URL            string
+	Regions        tagFlag
+	ForcePathStyle bool
+}
+
+// addEndpointFlags registers the endpoint flags on fs.
+func addEndpointFlags(fs *flag.FlagSet) *endpointOptions {
+	ep := &endpointOptions{Regions: tagFlag{}}
+	fs.StringVar(&ep.URL, "endpoint-url", "", "Send requests to this endpoint instead of AWS, e.g. http://localhost:4566 for LocalStack (optional)")
+	fs.Var(ep.Regions, "region-endpoint", "Endpoint for one region, as region=url (repeatable); overrides --endpoint-url in that region")
+	fs.BoolVar(&ep.ForcePathStyle, "s3-force-path-style", false, "Address buckets as <endpoint>/<bucket> instead of <bucket>.<endpoint>, as MinIO and LocalStack need")
+	return ep
+}
+
+// resolver returns an endpoint resolver applying the overrides, or nil to use AWS's endpoints.
+func (ep *endpointOptions) resolver() endpoints.Resolver {
+	if ep.URL == "" && len(ep.Regions) == 0 {
+		return nil
+	}
+	return endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		endpoint := ep.URL
+		if u, ok := ep.Regions[region]; ok {
+			endpoint = u
+		}
+		if endpoint == "" {
+			return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+		}
+		return endpoints.ResolvedEndpoint{URL: endpoint, SigningRegion: region}, nil
+	})
+}
+
+// bucketRegion detects the region of a bucket, falling back to the given region if it cannot be determined.
+func bucketRegion(s3client *s3.S3, bucket, fallback string) string {
+	detectedRegion := fallback
+	locOut, err := s3client.GetBucketLocation(&s3.GetBucketLocationInput{
+		Bucket: aws.String(bucket),
+	})
+	if err == nil && locOut.LocationConstraint != nil {
+		detectedRegion = aws.StringValue(locOut.LocationConstraint)
+		if detectedRegion == "" {
+			detectedRegion = "us-east-1"
+		}
+		// AWS returns some regions as enums, e.g. EU, so handle that
+		if detectedRegion == "EU" {
+			detectedRegion = "eu-west-1"
+		}
+	}
+	return detectedRegion
+}
+
+// bucketFromArn returns the bucket name of an S3 bucket ARN in any partition (aws, aws-cn, aws-us-gov...).
+func bucketFromArn(s string) (string, error) {
+	parsed, err := arn.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("%q is not an ARN: %w", s, err)
+	}
+	if parsed.Service != "s3" || parsed.Region != "" || parsed.AccountID != "" {
+		return "", fmt.Errorf("%q is not an S3 bucket ARN", s)
+	}
+	if parsed.Resource == "" || strings.Contains(parsed.Resource, "/") {
+		return "", fmt.Errorf("%q does not name a bucket", s)
+	}
+	return parsed.Resource, nil
+}
+
+// filterFromRule extracts the prefix and tags a rule filters on, whatever shape its filter has.
+func filterFromRule(rule *s3.ReplicationRule) ruleFilter {
+	f := ruleFilter{Tags: make(map[string]string), Priority: aws.Int64Value(rule.Priority)}
+	if rule.Destination != nil {
+		f.StorageClass = aws.StringValue(rule.Destination.StorageClass)
+	}
+	if rule.Filter == nil {
+		// Legacy rules put the prefix at the top level
+		f.Prefix = aws.StringValue(rule.Prefix)
+		return f
+	}
+	f.Prefix = aws.StringValue(rule.Filter.Prefix)
+	if t := rule.Filter.Tag; t != nil {
+		f.Tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	if and := rule.Filter.And; and != nil {
+		f.Prefix = aws.StringValue(and.Prefix)
+		for _, t := range and.Tags {
+			f.Tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+	}
+	return f
+}
+
+// matchesAny reports whether any of the filters selects the object.
+func matchesAny(filters []ruleFilter, key string, tags map[string]string) bool {
+	for _, f := range filters {
+		if f.matches(key, tags) {
+			return true
+		}
+	}
+	return false
+}
+
+// winningRule returns the highest priority rule selecting the object; S3 applies that one when rules overlap.
+func winningRule(filters []ruleFilter, key string, tags map[string]string) (ruleFilter, bool) {
+	var best ruleFilter
+	found := false
+	for _, f := range filters {
+		if f.matches(key, tags) && (!found || f.Priority > best.Priority) {
+			best = f
+			found = true
+		}
+	}
+	return best, found
+}
+
+// describeFilter renders a filter for output.
+func describeFilter(f ruleFilter) string {
+	desc := "all objects"
+	if f.Prefix != "" {
+		desc = fmt.Sprintf("prefix %q", f.Prefix)
+	}
+	if len(f.Tags) > 0 {
+		desc += ", tags " + tagFlag(f.Tags).String()
+	}
+	if f.StorageClass != "" {
+		desc += ", storage class " + f.StorageClass
+	}
+	return desc
+}
+
+// storageClassOrStandard fills in STANDARD, which HeadObject leaves out.
+func storageClassOrStandard(class string) string {
+	if class == "" {
+		return "STANDARD"
+	}
+	return class
+}
+
+// listStorageClasses maps every object key in a bucket to its storage class.
+func listStorageClasses(s3client *s3.S3, bucket string) (map[string]string, error) {
+	classes := make(map[string]string)
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+	}
+	err := s3client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			classes[*obj.Key] = storageClassOrStandard(aws.StringValue(obj.StorageClass))
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, err
+	}
+	return classes, nil
+}
+
+// getObjectTags returns the tags of an object.
+func getObjectTags(s3client *s3.S3, bucket, key string) (map[string]string, error) {
+	out, err := s3client.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(out.TagSet))
+	for _, t := range out.TagSet {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags, nil
 }
 
 // listObjects fetches all object keys in a bucket